@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// adminOnly guards an admin endpoint with the admin keys when any are
+// configured. Without admin keys the endpoint is protected like the rest of
+// the API by the regular API keys; with no keys at all, requests that would
+// change the pool are refused rather than left open to anyone.
+func (s *server) adminOnly(h http.HandlerFunc) http.Handler {
+	switch {
+	case s.admin != nil:
+		return s.admin.Middleware(h)
+	case s.requireKeys:
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h(w, r)
+			return
+		}
+		writeError(w, http.StatusForbidden, "admin_keys_required", "admin endpoints that change the pool need -admin-keys or -api-keys")
+	})
+}
+
+func (s *server) handleListProxies(w http.ResponseWriter, r *http.Request) {
+	proxies := s.pool.Inventory()
+	for i := range proxies {
+		proxies[i].Config.Password = ""
+	}
+	writeJSON(w, http.StatusOK, proxies)
+}
+
+// handleAddProxy adds one proxy, given in the same form as a config file
+// entry. Runtime additions last until the next config reload or provider
+// refresh replaces the list.
+func (s *server) handleAddProxy(w http.ResponseWriter, r *http.Request) {
+	var entry proxyEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid JSON body: "+err.Error())
+		return
+	}
+	p, err := entry.toProxy()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_proxy", err.Error())
+		return
+	}
+	if err := s.pool.Add(p); err != nil {
+		writeError(w, http.StatusConflict, errorCode(err), err.Error())
+		return
+	}
+	slog.Info("proxy added", "proxy", p.String())
+	s.checker.Recheck(p)
+	writeJSON(w, http.StatusCreated, p.WithoutCredentials())
+}
+
+// handleRemoveProxy removes the proxy whose id (as shown in /stats) is the
+// path-escaped final segment, e.g. /proxies/http%3A%2F%2F10.0.0.1%3A3128.
+func (s *server) handleRemoveProxy(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.pool.Remove(id); err != nil {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+	slog.Info("proxy removed", "proxy", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkResponse is the result of POST /check.
+type checkResponse struct {
+	Checked int           `json:"checked"`
+	Healthy int           `json:"healthy"`
+	Proxies []checkOutput `json:"proxies"`
+}
+
+// handleCheck runs a health-check pass over the whole pool right away and
+// returns its results. A pass already in progress is joined rather than
+// repeated. The pass is not cut short if the client disconnects, since
+// other callers may be waiting on it; each check is bounded by its timeout.
+func (s *server) handleCheck(w http.ResponseWriter, r *http.Request) {
+	results := s.checker.CheckAll(context.WithoutCancel(r.Context()))
+	if results == nil {
+		writeError(w, http.StatusServiceUnavailable, "check_cancelled", "health check was cancelled")
+		return
+	}
+	resp := checkResponse{Checked: len(results), Proxies: make([]checkOutput, len(results))}
+	for i, res := range results {
+		resp.Proxies[i] = newCheckOutput(res, s.checker.ChecksHTTPS())
+		if res.Err == nil {
+			resp.Healthy++
+		}
+	}
+	slog.Info("manual health check", "checked", resp.Checked, "healthy", resp.Healthy)
+	writeJSON(w, http.StatusOK, resp)
+}
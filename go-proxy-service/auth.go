@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKeyAuth requires every request to carry one of a fixed set of keys.
+// Keys are stored and compared as SHA-256 digests so the comparison is
+// constant-time regardless of key length.
+type apiKeyAuth struct {
+	digests [][sha256.Size]byte
+}
+
+func newAPIKeyAuth(keys []string) *apiKeyAuth {
+	a := &apiKeyAuth{}
+	for _, k := range keys {
+		a.digests = append(a.digests, sha256.Sum256([]byte(k)))
+	}
+	return a
+}
+
+// loadAPIKeys combines a comma-separated key list with the keys in file,
+// one per line. Blank lines and lines starting with # are ignored.
+func loadAPIKeys(list, file string) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(list, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if file == "" {
+		return keys, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("read api keys: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k := strings.TrimSpace(sc.Text())
+		if k != "" && !strings.HasPrefix(k, "#") {
+			keys = append(keys, k)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// valid reports whether key matches any configured key. Every configured
+// key is compared so timing does not reveal which one matched.
+func (a *apiKeyAuth) valid(key string) bool {
+	if key == "" {
+		return false
+	}
+	d := sha256.Sum256([]byte(key))
+	match := 0
+	for i := range a.digests {
+		match |= subtle.ConstantTimeCompare(d[:], a.digests[i][:])
+	}
+	return match == 1
+}
+
+// Middleware rejects requests without a valid key. API requests present the
+// key as "Authorization: Bearer <key>" or "X-API-Key: <key>"; forward-proxy
+// requests use Proxy-Authorization, either as a bearer token or as the
+// password of basic credentials.
+func (a *apiKeyAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProxyRequest(r) {
+			if !a.valid(proxyKey(r)) {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="proxy-service"`)
+				writeError(w, http.StatusProxyAuthRequired, "invalid_api_key", "missing or invalid API key")
+				return
+			}
+		} else if !a.valid(requestKey(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxy-service"`)
+			writeError(w, http.StatusUnauthorized, "invalid_api_key", "missing or invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestKey(r *http.Request) string {
+	if k, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(k)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+func proxyKey(r *http.Request) string {
+	h := r.Header.Get("Proxy-Authorization")
+	if k, ok := strings.CutPrefix(h, "Bearer "); ok {
+		return strings.TrimSpace(k)
+	}
+	if enc, ok := strings.CutPrefix(h, "Basic "); ok {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return ""
+		}
+		_, pass, _ := strings.Cut(string(raw), ":")
+		return pass
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	h := newAPIKeyAuth([]string{"k1", "k2"}).Middleware(okHandler)
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"bearer", "Authorization", "Bearer k1", http.StatusOK},
+		{"x-api-key", "X-API-Key", "k2", http.StatusOK},
+		{"wrong bearer", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"wrong x-api-key", "X-API-Key", "k3", http.StatusUnauthorized},
+		{"basic scheme", "Authorization", "Basic azE=", http.StatusUnauthorized},
+		{"no key", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/stats", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthForwardRequests(t *testing.T) {
+	h := newAPIKeyAuth([]string{"k1"}).Middleware(okHandler)
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{"bearer", "Bearer k1", http.StatusOK},
+		{"basic password", "Basic dXNlcjprMQ==", http.StatusOK}, // user:k1
+		{"wrong password", "Basic dXNlcjprMg==", http.StatusProxyAuthRequired},
+		{"no credentials", "", http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.test/", nil)
+			if tt.value != "" {
+				req.Header.Set("Proxy-Authorization", tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(file, []byte("# team keys\nk3\n\n  k4  \n"), 0o600)
+
+	keys, err := loadAPIKeys(" k1, ,k2", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"k1", "k2", "k3", "k4"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	if _, err := loadAPIKeys("", filepath.Join(t.TempDir(), "absent")); err == nil {
+		t.Error("missing key file was not an error")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// Circuit breaker states, as shown in /stats.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breaker is a per-proxy circuit breaker driven by client reports. After
+// enough consecutive failures it opens and the proxy is excluded. Once the
+// cooldown has passed it is half-open: one trial handout is allowed, and
+// the report on that trial either closes the breaker or opens it again.
+//
+// A trial that is never reported on lapses after another cooldown, so one
+// forgetful client cannot keep the proxy out of rotation.
+type breaker struct {
+	failures   int       // consecutive failures
+	openUntil  time.Time // zero while closed
+	trialUntil time.Time // a half-open trial is outstanding until then
+}
+
+func (b *breaker) state(now time.Time) string {
+	switch {
+	case b.openUntil.IsZero():
+		return breakerClosed
+	case now.Before(b.openUntil):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+// allows reports whether the proxy may be handed out.
+func (b *breaker) allows(now time.Time) bool {
+	switch b.state(now) {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return !now.Before(b.trialUntil)
+	}
+	return true
+}
+
+// handedOut starts a trial if the breaker is half-open.
+func (b *breaker) handedOut(now time.Time, cooldown time.Duration) {
+	if b.state(now) == breakerHalfOpen {
+		b.trialUntil = now.Add(cooldown)
+	}
+}
+
+// record applies one reported outcome. A threshold of zero disables the
+// breaker.
+func (b *breaker) record(success bool, now time.Time, threshold int, cooldown time.Duration) {
+	if success {
+		*b = breaker{}
+		return
+	}
+	b.failures++
+	if threshold > 0 && (b.state(now) == breakerHalfOpen || b.failures >= threshold) {
+		b.openUntil = now.Add(cooldown)
+		b.trialUntil = time.Time{}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// checkOutput is one row of `check -json` output, and of the POST /check
+// response.
+type checkOutput struct {
+	Proxy     string  `json:"proxy"`
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	// HTTPSReachable and HTTPSError are set when HTTPS is checked too.
+	HTTPSReachable *bool  `json:"https_reachable,omitempty"`
+	HTTPSError     string `json:"https_error,omitempty"`
+}
+
+func newCheckOutput(res checkResult, https bool) checkOutput {
+	out := checkOutput{
+		Proxy:     res.Proxy.String(),
+		Reachable: res.Err == nil,
+		LatencyMs: float64(res.Latency) / float64(time.Millisecond),
+	}
+	if res.Err != nil {
+		out.Error = res.Err.Error()
+	}
+	if https {
+		ok := res.HTTPSErr == nil
+		out.HTTPSReachable = &ok
+		if !ok {
+			out.HTTPSError = res.HTTPSErr.Error()
+		}
+	}
+	return out
+}
+
+// runCheck implements the `check` subcommand: test every configured proxy
+// once, print the results and return a non-zero exit status if any failed.
+// It takes the same flags and PROXY_* variables as the server, plus -json.
+func runCheck(args []string) int {
+	var asJSON bool
+	cfg, _, err := parseSettings("check", args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print results as JSON")
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	logger, _ := newLogger("warn")
+	slog.SetDefault(logger)
+
+	proxies, _, stopMocks, err := startingProxies(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer stopMocks()
+
+	checker := NewHealthChecker(nil, healthOptions{
+		CheckURL:    cfg.CheckURL,
+		HTTPSURL:    cfg.CheckHTTPSURL,
+		Expect:      cfg.CheckExpect,
+		Resolver:    newResolver(cfg.Resolver),
+		Timeout:     cfg.CheckTimeout,
+		Concurrency: cfg.CheckConcurrency,
+	})
+	https := checker.ChecksHTTPS()
+	results := checker.Probe(context.Background(), proxies)
+
+	failed := 0
+	out := make([]checkOutput, len(results))
+	for i, res := range results {
+		out[i] = newCheckOutput(res, https)
+		if res.Err != nil || res.HTTPSErr != nil {
+			failed++
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		if https {
+			fmt.Fprintln(tw, "PROXY\tREACHABLE\tLATENCY\tHTTPS\tERROR")
+		} else {
+			fmt.Fprintln(tw, "PROXY\tREACHABLE\tLATENCY\tERROR")
+		}
+		for _, o := range out {
+			if https {
+				fmt.Fprintf(tw, "%s\t%t\t%.0fms\t%t\t%s\n", o.Proxy, o.Reachable, o.LatencyMs, *o.HTTPSReachable, joinErrors(o.Error, o.HTTPSError))
+			} else {
+				fmt.Fprintf(tw, "%s\t%t\t%.0fms\t%s\n", o.Proxy, o.Reachable, o.LatencyMs, o.Error)
+			}
+		}
+		tw.Flush()
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// joinErrors combines the plain and HTTPS check errors for the table.
+func joinErrors(plain, https string) string {
+	switch {
+	case https == "":
+		return plain
+	case plain == "":
+		return "https: " + https
+	}
+	return plain + "; https: " + https
+}
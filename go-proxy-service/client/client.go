@@ -0,0 +1,222 @@
+// Package client is a Go client for the proxy service API. Besides plain
+// calls to /get-proxy and /report it provides Transport, an
+// http.RoundTripper that routes every request through a freshly selected
+// proxy and reports the outcome back to the service.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxy is an upstream proxy as returned by /get-proxy.
+type Proxy struct {
+	Scheme   string   `json:"scheme"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Country  string   `json:"country,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+
+	// LeaseID and ExpiresAt are set when the service hands out leases
+	// (-lease-ttl). The lease is ended by Report or Release.
+	LeaseID   string    `json:"-"`
+	ExpiresAt time.Time `json:"-"`
+	// Session is the session token the proxy was bound to, if any. Report
+	// passes it on so the session's slot is freed only once.
+	Session string `json:"-"`
+}
+
+// String identifies the proxy to the service, as scheme://host:port.
+func (p Proxy) String() string {
+	return p.Scheme + "://" + net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+}
+
+// URL returns the proxy URL including credentials, ready for
+// http.ProxyURL.
+func (p Proxy) URL() *url.URL {
+	u := &url.URL{Scheme: p.Scheme, Host: net.JoinHostPort(p.Host, strconv.Itoa(p.Port))}
+	if p.Username != "" || p.Password != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u
+}
+
+// GetProxyOptions narrows which proxy /get-proxy may return. Zero values
+// leave the corresponding filter off.
+type GetProxyOptions struct {
+	// Country is a comma-separated list of country codes.
+	Country string
+	// Type is the upstream protocol, "http" or "socks5".
+	Type string
+	// Tags must all be carried by the proxy.
+	Tags []string
+	// Session keeps returning the same proxy for the same token.
+	Session string
+}
+
+func (o GetProxyOptions) query() url.Values {
+	q := url.Values{}
+	if o.Country != "" {
+		q.Set("country", o.Country)
+	}
+	if o.Type != "" {
+		q.Set("type", o.Type)
+	}
+	for _, t := range o.Tags {
+		q.Add("tag", t)
+	}
+	if o.Session != "" {
+		q.Set("session", o.Session)
+	}
+	return q
+}
+
+// APIError is a non-success response from the service.
+type APIError struct {
+	StatusCode int
+	// Code is the service's error code, such as "no_matching_proxies" or
+	// "rate_limited"; empty if the response carried none.
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("proxy service: %d %s", e.StatusCode, e.Message)
+}
+
+// Client talks to one proxy service instance. It is safe for concurrent
+// use.
+type Client struct {
+	baseURL string
+	apiKey  string
+
+	// HTTPClient is used for calls to the service itself.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the service at baseURL, e.g.
+// "http://localhost:8080". apiKey may be empty if the service does not
+// require one.
+func NewClient(baseURL, apiKey string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// GetProxy asks the service for a proxy matching opts.
+func (c *Client) GetProxy(ctx context.Context, opts GetProxyOptions) (Proxy, error) {
+	u := c.baseURL + "/get-proxy"
+	if q := opts.query(); len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	// The reply is either the proxy itself or a lease wrapping it.
+	var body struct {
+		Proxy
+		Leased    *Proxy    `json:"proxy"`
+		LeaseID   string    `json:"lease_id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := c.do(ctx, http.MethodGet, u, nil, &body); err != nil {
+		return Proxy{}, err
+	}
+	p := body.Proxy
+	if body.Leased != nil {
+		p = *body.Leased
+		p.LeaseID, p.ExpiresAt = body.LeaseID, body.ExpiresAt
+	}
+	p.Session = opts.Session
+	return p, nil
+}
+
+// Report tells the service how a request through p went, which also frees
+// the concurrency slot it was handed out with. A zero latency means it was
+// not measured.
+func (c *Client) Report(ctx context.Context, p Proxy, success bool, latency time.Duration) error {
+	body := map[string]any{"proxy": p.String(), "success": success}
+	if latency > 0 {
+		body["latency_ms"] = latency.Milliseconds()
+	}
+	if p.LeaseID != "" {
+		body["lease_id"] = p.LeaseID
+	}
+	if p.Session != "" {
+		body["session"] = p.Session
+	}
+	return c.do(ctx, http.MethodPost, c.baseURL+"/report", body, nil)
+}
+
+// Release ends p's lease without reporting on it. It does nothing for a
+// proxy that was not leased.
+func (c *Client) Release(ctx context.Context, p Proxy) error {
+	if p.LeaseID == "" {
+		return nil
+	}
+	return c.do(ctx, http.MethodPost, c.baseURL+"/release", map[string]string{"lease_id": p.LeaseID}, nil)
+}
+
+// ReportFailure reports that a request through p failed.
+func (c *Client) ReportFailure(ctx context.Context, p Proxy) error {
+	return c.Report(ctx, p, false, 0)
+}
+
+func (c *Client) do(ctx context.Context, method, target string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func decodeError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error.Message == "" {
+		return &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	}
+	return &APIError{StatusCode: resp.StatusCode, Code: body.Error.Code, Message: body.Error.Message}
+}
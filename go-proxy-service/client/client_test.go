@@ -0,0 +1,248 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService stands in for the proxy service, handing out upstream and
+// recording reports.
+type fakeService struct {
+	*httptest.Server
+	upstream Proxy
+	// leaseID, if set, makes /get-proxy answer with a lease.
+	leaseID string
+
+	mu      sync.Mutex
+	queries []string
+	reports []map[string]any
+}
+
+func newFakeService(t *testing.T, upstream Proxy) *fakeService {
+	s := &fakeService{upstream: upstream}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /get-proxy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			writeError(w, http.StatusUnauthorized, "invalid_api_key", "missing or invalid API key")
+			return
+		}
+		s.mu.Lock()
+		s.queries = append(s.queries, r.URL.RawQuery)
+		s.mu.Unlock()
+		if r.URL.Query().Get("country") == "ZZ" {
+			writeError(w, http.StatusNotFound, "no_matching_proxies", "no proxies match the request")
+			return
+		}
+		if s.leaseID != "" {
+			json.NewEncoder(w).Encode(map[string]any{
+				"proxy":      s.upstream,
+				"lease_id":   s.leaseID,
+				"expires_at": time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(s.upstream)
+	})
+	mux.HandleFunc("POST /report", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mu.Lock()
+		s.reports = append(s.reports, body)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// writeError answers like the service does on errors.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": code, "message": msg}})
+}
+
+func (s *fakeService) lastReport(t *testing.T) map[string]any {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.reports) == 0 {
+		t.Fatal("no report was sent")
+	}
+	return s.reports[len(s.reports)-1]
+}
+
+// newFakeProxy starts an HTTP forward proxy that answers every request
+// itself, echoing the target URL, so tests need no network access.
+func newFakeProxy(t *testing.T) Proxy {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "via proxy: "+r.URL.String())
+	}))
+	t.Cleanup(srv.Close)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	n, _ := strconv.Atoi(port)
+	return Proxy{Scheme: "http", Host: host, Port: n}
+}
+
+func TestGetProxy(t *testing.T) {
+	upstream := Proxy{Scheme: "http", Host: "10.0.0.1", Port: 3128, Username: "u", Password: "p", Country: "US"}
+	svc := newFakeService(t, upstream)
+	c := NewClient(svc.URL+"/", "secret")
+
+	got, err := c.GetProxy(context.Background(), GetProxyOptions{Country: "US", Tags: []string{"mobile", "search"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != upstream.String() || got.Password != "p" {
+		t.Fatalf("GetProxy() = %+v, want %+v", got, upstream)
+	}
+	if want := "country=US&tag=mobile&tag=search"; svc.queries[0] != want {
+		t.Errorf("query = %q, want %q", svc.queries[0], want)
+	}
+	if got := got.URL().String(); got != "http://u:p@10.0.0.1:3128" {
+		t.Errorf("URL() = %s", got)
+	}
+}
+
+func TestGetProxyLease(t *testing.T) {
+	upstream := Proxy{Scheme: "http", Host: "10.0.0.1", Port: 3128}
+	svc := newFakeService(t, upstream)
+	svc.leaseID = "0123456789abcdef0123456789abcdef"
+	c := NewClient(svc.URL, "secret")
+
+	got, err := c.GetProxy(context.Background(), GetProxyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != upstream.String() || got.LeaseID != "0123456789abcdef0123456789abcdef" || got.ExpiresAt.Year() != 2030 {
+		t.Fatalf("GetProxy() = %+v, want leased %s", got, upstream)
+	}
+
+	if err := c.ReportFailure(context.Background(), got); err != nil {
+		t.Fatal(err)
+	}
+	if r := svc.lastReport(t); r["lease_id"] != got.LeaseID {
+		t.Fatalf("report = %v, want lease_id %s", r, got.LeaseID)
+	}
+}
+
+func TestGetProxySessionReport(t *testing.T) {
+	svc := newFakeService(t, Proxy{Scheme: "http", Host: "10.0.0.1", Port: 3128})
+	c := NewClient(svc.URL, "secret")
+
+	got, err := c.GetProxy(context.Background(), GetProxyOptions{Session: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Report(context.Background(), got, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if r := svc.lastReport(t); r["session"] != "s1" {
+		t.Fatalf("report = %v, want session s1", r)
+	}
+}
+
+func TestGetProxyErrors(t *testing.T) {
+	svc := newFakeService(t, Proxy{})
+
+	tests := []struct {
+		name   string
+		key    string
+		opts   GetProxyOptions
+		status int
+		code   string
+		msg    string
+	}{
+		{"unauthorized", "wrong", GetProxyOptions{}, http.StatusUnauthorized, "invalid_api_key", "missing or invalid API key"},
+		{"no match", "secret", GetProxyOptions{Country: "ZZ"}, http.StatusNotFound, "no_matching_proxies", "no proxies match the request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClient(svc.URL, tt.key).GetProxy(context.Background(), tt.opts)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want *APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.code || apiErr.Message != tt.msg {
+				t.Errorf("error = %d %s %q, want %d %s %q", apiErr.StatusCode, apiErr.Code, apiErr.Message, tt.status, tt.code, tt.msg)
+			}
+		})
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	svc := newFakeService(t, Proxy{})
+	p := Proxy{Scheme: "socks5", Host: "10.0.0.2", Port: 1080}
+
+	if err := NewClient(svc.URL, "secret").ReportFailure(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	r := svc.lastReport(t)
+	if r["proxy"] != "socks5://10.0.0.2:1080" || r["success"] != false {
+		t.Fatalf("report = %v", r)
+	}
+}
+
+func TestTransportRoutesAndReports(t *testing.T) {
+	upstream := newFakeProxy(t)
+	svc := newFakeService(t, upstream)
+	hc := &http.Client{Transport: &Transport{Client: NewClient(svc.URL, "secret")}}
+
+	resp, err := hc.Get("http://example.test/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "via proxy: http://example.test/page" {
+		t.Fatalf("body = %q, want it to come through the proxy", body)
+	}
+	if r := svc.lastReport(t); r["proxy"] != upstream.String() || r["success"] != true {
+		t.Fatalf("report = %v, want success for %s", r, upstream)
+	}
+
+	resp, err = hc.Get("http://example.test/broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if r := svc.lastReport(t); r["success"] != false {
+		t.Fatalf("report after 502 = %v, want failure", r)
+	}
+}
+
+func TestTransportReportsConnectionFailure(t *testing.T) {
+	// Nothing listens on the upstream's port once the listener is closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	svc := newFakeService(t, Proxy{Scheme: "http", Host: "127.0.0.1", Port: port})
+	hc := &http.Client{Transport: &Transport{Client: NewClient(svc.URL, "secret")}}
+
+	if _, err := hc.Get("http://example.test/"); err == nil {
+		t.Fatal("request through a dead proxy succeeded")
+	}
+	if r := svc.lastReport(t); r["success"] != false {
+		t.Fatalf("report = %v, want failure", r)
+	}
+}
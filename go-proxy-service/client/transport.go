@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that sends each request through a proxy
+// obtained from the service and reports the outcome: a transport error or a
+// 5xx response counts as a failure, anything else as a success.
+//
+//	c := client.NewClient("http://localhost:8080", key)
+//	hc := &http.Client{Transport: &client.Transport{Client: c}}
+type Transport struct {
+	Client *Client
+	// Options are applied to every proxy request.
+	Options GetProxyOptions
+	// ReportTimeout bounds the report sent after each request; it defaults
+	// to five seconds.
+	ReportTimeout time.Duration
+
+	// transports caches one http.Transport per proxy so connections through
+	// it are reused.
+	transports sync.Map
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := t.Client.GetProxy(req.Context(), t.Options)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.transport(p).RoundTrip(req)
+	success := err == nil && resp.StatusCode < 500
+	t.report(p, success, time.Since(start))
+	return resp, err
+}
+
+func (t *Transport) transport(p Proxy) *http.Transport {
+	id := p.String()
+	if rt, ok := t.transports.Load(id); ok {
+		return rt.(*http.Transport)
+	}
+	rt, _ := t.transports.LoadOrStore(id, &http.Transport{
+		Proxy:               http.ProxyURL(p.URL()),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	})
+	return rt.(*http.Transport)
+}
+
+// report is best-effort: a failure to reach the service must not turn a
+// successful request into an error.
+func (t *Transport) report(p Proxy, success bool, latency time.Duration) {
+	timeout := t.ReportTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	t.Client.Report(ctx, p, success, latency)
+}
+
+// CloseIdleConnections closes idle connections through every proxy used so
+// far.
+func (t *Transport) CloseIdleConnections() {
+	t.transports.Range(func(_, rt any) bool {
+		rt.(*http.Transport).CloseIdleConnections()
+		return true
+	})
+}
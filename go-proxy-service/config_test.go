@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestToProxyIPv6(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry proxyEntry
+		want  string // Proxy.String(), or an error substring after "error: "
+	}{
+		{"url", proxyEntry{URL: "http://[2001:db8::1]:3128"}, "http://[2001:db8::1]:3128"},
+		{"url with credentials", proxyEntry{URL: "socks5://u:p@[2001:db8::1]:1080"}, "socks5://[2001:db8::1]:1080"},
+		{"bare bracketed", proxyEntry{URL: "[::1]:8080"}, "http://[::1]:8080"},
+		{"canonical form", proxyEntry{URL: "http://[2001:DB8:0:0::1]:3128"}, "http://[2001:db8::1]:3128"},
+		{"host field", proxyEntry{Host: "2001:db8::1", Port: 3128}, "http://[2001:db8::1]:3128"},
+		{"bracketed host field", proxyEntry{Host: "[2001:db8::1]", Port: 3128}, "http://[2001:db8::1]:3128"},
+		{"ipv4 unchanged", proxyEntry{Host: "10.0.0.1", Port: 3128}, "http://10.0.0.1:3128"},
+		{"unbracketed url", proxyEntry{URL: "http://2001:db8::1:3128"}, "error: must be in brackets"},
+		{"invalid literal in url", proxyEntry{URL: "http://[2001:db8::zz]:3128"}, "error: invalid host"},
+		{"invalid host field", proxyEntry{Host: "2001:db8:::1", Port: 3128}, `error: invalid IPv6 address "2001:db8:::1"`},
+		{"bracketed ipv4", proxyEntry{Host: "[10.0.0.1]", Port: 3128}, "error: invalid IPv6 address"},
+		{"missing port", proxyEntry{URL: "http://[2001:db8::1]"}, "error: missing or invalid port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.entry.toProxy()
+			if msg, ok := strings.CutPrefix(tt.want, "error: "); ok {
+				if err == nil || !strings.Contains(err.Error(), msg) {
+					t.Fatalf("toProxy() error = %v, want one containing %q", err, msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.String() != tt.want {
+				t.Errorf("toProxy() = %s, want %s", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPv6ProxyURL(t *testing.T) {
+	p := Proxy{Scheme: schemeHTTP, Host: "2001:db8::1", Port: 3128, Username: "u", Password: "p"}
+	if got := p.URL().String(); got != "http://u:p@[2001:db8::1]:3128" {
+		t.Errorf("URL() = %s", got)
+	}
+	if got := p.Addr(); got != "[2001:db8::1]:3128" {
+		t.Errorf("Addr() = %s", got)
+	}
+}
+
+func TestLoadProxiesValidatesAndDeduplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.json")
+	os.WriteFile(path, []byte(`{"proxies": [
+		{"url": "http://u:p@10.0.0.1:3128", "country": "de"},
+		{"host": "10.0.0.1", "port": 3128},
+		{"url": "socks5://10.0.0.2:1080"},
+		{"url": "ftp://10.0.0.3:21"},
+		{"host": "10.0.0.4", "port": 70000},
+		{"host": "10.0.0.5"},
+		{"url": "http://10.0.0.6:3128", "weight": -1}
+	]}`), 0o600)
+
+	proxies, err := loadProxies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range proxies {
+		got = append(got, p.String())
+	}
+	if want := "http://10.0.0.1:3128 socks5://10.0.0.2:1080"; strings.Join(got, " ") != want {
+		t.Fatalf("loaded %v, want %s", got, want)
+	}
+	if p := proxies[0]; p.Username != "u" || p.Password != "p" || p.Country != "DE" {
+		t.Errorf("first entry = %+v, want its credentials and country kept", p)
+	}
+}
+
+func TestLoadProxiesWithoutValidEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.json")
+	os.WriteFile(path, []byte(`{"proxies": [{"url": "ftp://10.0.0.3:21"}]}`), 0o600)
+	if _, err := loadProxies(path); err == nil || !strings.Contains(err.Error(), "no valid proxies") {
+		t.Errorf("err = %v, want no valid proxies", err)
+	}
+	if _, err := loadProxies(filepath.Join(t.TempDir(), "absent.json")); err == nil {
+		t.Error("missing config file was not an error")
+	}
+}
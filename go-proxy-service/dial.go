@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// newUpstreamTransport returns an http.Transport that sends every request
+// through upstream. HTTP proxies use the standard proxy support; SOCKS5
+// proxies are dialed with golang.org/x/net/proxy. A nil resolver means the
+// system one.
+func newUpstreamTransport(upstream Proxy, dialTimeout time.Duration, resolver *net.Resolver) *http.Transport {
+	base := &net.Dialer{Timeout: dialTimeout, Resolver: resolver}
+	if upstream.Scheme != schemeSOCKS5 {
+		return &http.Transport{
+			Proxy:       http.ProxyURL(upstream.URL()),
+			DialContext: base.DialContext,
+		}
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSOCKS5(ctx, base, upstream, addr)
+		},
+	}
+}
+
+// dialThrough opens a raw TCP connection to target via upstream, using a
+// CONNECT tunnel for HTTP proxies.
+func dialThrough(ctx context.Context, upstream Proxy, target string, dialTimeout time.Duration, resolver *net.Resolver) (net.Conn, error) {
+	base := &net.Dialer{Timeout: dialTimeout, Resolver: resolver}
+	if upstream.Scheme == schemeSOCKS5 {
+		return dialSOCKS5(ctx, base, upstream, target)
+	}
+	return dialConnect(ctx, base, upstream, target, dialTimeout)
+}
+
+// newResolver returns a resolver that sends every DNS query to the server
+// at addr (host or host:port; port 53 if omitted, IPv6 hosts bracketed or
+// not), or nil for addr "".
+func newResolver(addr string) *net.Resolver {
+	if addr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func dialSOCKS5(ctx context.Context, base *net.Dialer, upstream Proxy, target string) (net.Conn, error) {
+	var auth *xproxy.Auth
+	if upstream.Username != "" {
+		auth = &xproxy.Auth{User: upstream.Username, Password: upstream.Password}
+	}
+	d, err := xproxy.SOCKS5("tcp", upstream.Addr(), auth, base)
+	if err != nil {
+		return nil, err
+	}
+	return d.(xproxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
+
+// dialConnect opens a CONNECT tunnel to target through an HTTP upstream.
+// The handshake is bounded by timeout or ctx's deadline, whichever comes
+// first, and is abandoned as soon as ctx is cancelled.
+func dialConnect(ctx context.Context, base *net.Dialer, upstream Proxy, target string, timeout time.Duration) (net.Conn, error) {
+	conn, err := base.DialContext(ctx, "tcp", upstream.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if upstream.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(upstream.Username + ":" + upstream.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %s refused CONNECT: %s", upstream, resp.Status)
+	}
+	if !stop() {
+		// ctx ended just as the handshake completed and conn is closed.
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads drain a bufio.Reader first, so
+// bytes buffered while reading the CONNECT response are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// silentUpstream accepts connections and never answers on them.
+func silentUpstream(t *testing.T) Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return Proxy{Scheme: schemeHTTP, Host: addr.IP.String(), Port: addr.Port}
+}
+
+func TestDialConnectHonoursContext(t *testing.T) {
+	upstream := silentUpstream(t)
+	contexts := map[string]func() (context.Context, context.CancelFunc){
+		"deadline": func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		},
+		"cancel": func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			return ctx, cancel
+		},
+	}
+	for name, newContext := range contexts {
+		ctx, cancel := newContext()
+		start := time.Now()
+		conn, err := dialThrough(ctx, upstream, "example.test:443", 10*time.Second, nil)
+		cancel()
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: CONNECT to a silent upstream succeeded", name)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: CONNECT gave up after %s, want it bounded by ctx", name, elapsed)
+		}
+	}
+}
+
+// startSOCKS5 starts a SOCKS5 proxy that relays CONNECT requests to their
+// targets, requiring username and password authentication when user is set.
+func startSOCKS5(t *testing.T, user, pass string) Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, user, pass)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return Proxy{Scheme: schemeSOCKS5, Host: addr.IP.String(), Port: addr.Port, Username: user, Password: pass, Weight: defaultWeight}
+}
+
+func serveSOCKS5(conn net.Conn, user, pass string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Greeting: version, methods offered. Pick no auth or username/password.
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(r, make([]byte, head[1])); err != nil {
+		return
+	}
+	if user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		gotUser, gotPass, err := readSOCKS5Credentials(r)
+		if err != nil || gotUser != user || gotPass != pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request: version, command, reserved, address type, address, port.
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+// readSOCKS5Credentials reads a username/password subnegotiation.
+func readSOCKS5Credentials(r *bufio.Reader) (string, string, error) {
+	field := func() (string, error) {
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	if _, err := r.ReadByte(); err != nil {
+		return "", "", err
+	}
+	user, err := field()
+	if err != nil {
+		return "", "", err
+	}
+	pass, err := field()
+	return user, pass, err
+}
+
+func TestDialThroughSOCKS5(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	upstream := startSOCKS5(t, "u", "p")
+	conn, err := dialThrough(context.Background(), upstream, echo.Addr().String(), time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo through SOCKS5 = %q, %v", got, err)
+	}
+
+	upstream.Password = "wrong"
+	if conn, err := dialThrough(context.Background(), upstream, echo.Addr().String(), time.Second, nil); err == nil {
+		conn.Close()
+		t.Error("SOCKS5 dial with a wrong password succeeded")
+	}
+}
+
+func TestForwardThroughSOCKS5(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer target.Close()
+
+	f := newTestForwarder(NewProxyPool([]Proxy{startSOCKS5(t, "", "")}, PoolOptions{}))
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target.URL+"/page", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello /page" {
+		t.Errorf("forward through SOCKS5 = %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Pool event types.
+const (
+	eventHealthy   = "healthy"
+	eventUnhealthy = "unhealthy"
+	eventBanned    = "banned"
+	eventHandout   = "handout"
+)
+
+// poolEvent is one change in the pool, as pushed to /events subscribers.
+type poolEvent struct {
+	Type  string    `json:"type"`
+	Proxy string    `json:"proxy"`
+	Time  time.Time `json:"time"`
+	// Until is when a ban ends.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// eventBuffer is how many events a subscriber may fall behind by before it
+// is disconnected.
+const eventBuffer = 256
+
+// eventHub fans pool events out to any number of subscribers. Publish never
+// blocks: a subscriber whose buffer is full is dropped instead, so one slow
+// client cannot hold up the pool.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan poolEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan poolEvent]struct{})}
+}
+
+// Subscribe returns a channel of events, closed when the subscriber falls
+// too far behind or Unsubscribe is called.
+func (h *eventHub) Subscribe() chan poolEvent {
+	ch := make(chan poolEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) Unsubscribe(ch chan poolEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish sends ev to every subscriber. It is safe to call on a nil hub.
+func (h *eventHub) Publish(ev poolEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+const (
+	eventsWriteTimeout = 10 * time.Second
+	eventsPingInterval = 30 * time.Second
+)
+
+// upgrader answers failed upgrades with the usual JSON error envelope.
+var upgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, status, "websocket_upgrade_failed", reason.Error())
+	},
+}
+
+// parseOrigins parses a comma-separated list of origins allowed to open
+// /events, each scheme://host[:port], or "*" for any origin.
+func parseOrigins(list string) (map[string]bool, error) {
+	origins := make(map[string]bool)
+	for _, o := range strings.Split(list, ",") {
+		o = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(o), "/"))
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+				return nil, fmt.Errorf("invalid origin %q (want scheme://host[:port] or *)", o)
+			}
+		}
+		origins[o] = true
+	}
+	return origins, nil
+}
+
+// checkEventsOrigin accepts WebSocket upgrades from the service's own
+// origin, from the -events-origins list and from non-browser clients, which
+// send no Origin header.
+func (s *server) checkEventsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.eventsOrigins["*"] || s.eventsOrigins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleEvents streams pool events to a WebSocket client as JSON messages
+// until it disconnects or falls behind.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	u := upgrader
+	u.CheckOrigin = s.checkEventsOrigin
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error status.
+		return
+	}
+	defer conn.Close()
+
+	events := s.events.Subscribe()
+	defer s.events.Unsubscribe(events)
+
+	// The client never sends anything we need, but reading is how close
+	// frames and disconnects are noticed.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventsWriteTimeout)); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				slog.Warn("event subscriber too slow, disconnecting", "remote_addr", r.RemoteAddr)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"),
+					time.Now().Add(eventsWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		}
+	}
+}
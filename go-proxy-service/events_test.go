@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventsOrigins(t *testing.T) {
+	tests := []struct {
+		allowed string
+		origin  string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "https://dash.example.com", false},
+		{"https://dash.example.com", "https://dash.example.com", true},
+		{"https://Dash.example.com/", "https://dash.EXAMPLE.com", true},
+		{"https://dash.example.com", "http://dash.example.com", false},
+		{"https://dash.example.com", "https://evil.example.com", false},
+		{"*", "https://evil.example.com", true},
+	}
+	for _, tt := range tests {
+		origins, err := parseOrigins(tt.allowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, _ := newTestAPI(t)
+		srv.events = newEventHub()
+		srv.eventsOrigins = origins
+		svc := httptest.NewServer(srv.routes())
+
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(svc.URL, "http")+"/events", header)
+		if got := err == nil; got != tt.want {
+			t.Errorf("origin %q with -events-origins %q: upgraded = %v, want %v", tt.origin, tt.allowed, got, tt.want)
+		}
+		if err == nil {
+			conn.Close()
+		} else if resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q with -events-origins %q: status %d, want 403", tt.origin, tt.allowed, resp.StatusCode)
+		}
+		svc.Close()
+	}
+
+	// The service's own origin is always allowed.
+	srv, _ := newTestAPI(t)
+	srv.events = newEventHub()
+	svc := httptest.NewServer(srv.routes())
+	defer svc.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(svc.URL, "http")+"/events", http.Header{"Origin": {svc.URL}})
+	if err != nil {
+		t.Fatalf("same-origin upgrade failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestParseOriginsRejectsInvalid(t *testing.T) {
+	for _, list := range []string{"dash.example.com", "ftp://dash.example.com", "https://dash.example.com/app", "https://"} {
+		if _, err := parseOrigins(list); err == nil {
+			t.Errorf("parseOrigins(%q) accepted an invalid origin", list)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type responseFormat string
+
+const (
+	formatJSON responseFormat = "json"
+	formatText responseFormat = "text"
+	formatCSV  responseFormat = "csv"
+)
+
+// negotiateFormat picks the /get-proxy response format. An explicit
+// ?format= wins and must name a supported format; otherwise the Accept
+// header is consulted, falling back to JSON.
+func negotiateFormat(r *http.Request) (responseFormat, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		switch responseFormat(strings.ToLower(f)) {
+		case formatJSON:
+			return formatJSON, nil
+		case formatText:
+			return formatText, nil
+		case formatCSV:
+			return formatCSV, nil
+		}
+		return "", fmt.Errorf("unsupported format %q (want json, text or csv)", f)
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return formatJSON, nil
+	case strings.Contains(accept, "text/csv"):
+		return formatCSV, nil
+	case strings.Contains(accept, "text/plain"):
+		return formatText, nil
+	}
+	return formatJSON, nil
+}
+
+// writeProxiesText writes one proxy URL per line.
+func writeProxiesText(w http.ResponseWriter, proxies []Proxy) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, p := range proxies {
+		fmt.Fprintln(w, p.URL())
+	}
+}
+
+// writeProxiesCSV writes a header row followed by one row per proxy.
+func writeProxiesCSV(w http.ResponseWriter, proxies []Proxy) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"scheme", "host", "port", "username", "password", "country"})
+	for _, p := range proxies {
+		cw.Write([]string{p.Scheme, p.Host, strconv.Itoa(p.Port), p.Username, p.Password, p.Country})
+	}
+	cw.Flush()
+}
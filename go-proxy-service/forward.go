@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const upstreamDialTimeout = 10 * time.Second
+
+// hopHeaders are connection-specific and must not be passed through a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// maxReplayBody is the largest request body buffered so that it can be
+// resent through another upstream on failover.
+const maxReplayBody = 1 << 20
+
+// forwardOptions controls failover in forward mode.
+type forwardOptions struct {
+	// Retries is how many other upstreams to try after the first fails.
+	Retries int
+	// RetryStatuses are upstream response codes treated as failures.
+	RetryStatuses map[int]bool
+	// RetryMethods are the HTTP methods safe to send more than once.
+	// CONNECT tunnels are always retried since nothing has been sent yet.
+	RetryMethods map[string]bool
+	// Recheck, if set, is called with each upstream that failed.
+	Recheck func(Proxy)
+	// Timeout bounds a whole forwarded request, or a tunnel's setup, across
+	// all attempts. Zero means no limit beyond the client's own.
+	Timeout time.Duration
+	// MaxResponseBytes caps a forwarded response body. Zero means no cap.
+	MaxResponseBytes int64
+	// MaxHeaderBytes caps a forwarded response's headers. Zero leaves the
+	// net/http default.
+	MaxHeaderBytes int64
+	// MaxInFlight caps concurrent forwarded requests and tunnels across all
+	// clients. Zero means no cap.
+	MaxInFlight int
+	// Resolver, if set, replaces the system resolver for reaching upstreams.
+	Resolver *net.Resolver
+}
+
+// statusClientClosed is the non-standard status (borrowed from nginx) logged
+// for requests abandoned by the client before the upstream answered.
+const statusClientClosed = 499
+
+// errUpstreamTimeout is returned when a forwarded request runs out of time.
+var errUpstreamTimeout = errors.New("upstream timed out")
+
+// forwarder is an HTTP/HTTPS forward proxy. Each client request is relayed
+// through an upstream proxy picked by the selector, with the upstream
+// credentials supplied by the service so clients never see them. When an
+// upstream fails, retryable requests fail over to a different one before
+// giving up with 502.
+type forwarder struct {
+	pool     *ProxyPool
+	selector Selector
+	opts     forwardOptions
+
+	// transports caches one http.Transport per upstream so connections are
+	// reused across requests.
+	transports sync.Map
+	// slots, when MaxInFlight is set, holds a token per request in flight.
+	slots chan struct{}
+}
+
+func newForwarder(pool *ProxyPool, selector Selector, opts forwardOptions) *forwarder {
+	f := &forwarder{pool: pool, selector: selector, opts: opts}
+	if opts.MaxInFlight > 0 {
+		f.slots = make(chan struct{}, opts.MaxInFlight)
+	}
+	return f
+}
+
+// parseRetryStatuses parses a comma-separated list of HTTP status codes.
+func parseRetryStatuses(list string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		code, err := strconv.Atoi(c)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status %q", c)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// parseRetryMethods parses a comma-separated list of HTTP methods.
+func parseRetryMethods(list string) map[string]bool {
+	methods := make(map[string]bool)
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			methods[strings.ToUpper(m)] = true
+		}
+	}
+	return methods
+}
+
+func (f *forwarder) transport(p Proxy) *http.Transport {
+	if t, ok := f.transports.Load(p.String()); ok {
+		return t.(*http.Transport)
+	}
+	nt := newUpstreamTransport(p, upstreamDialTimeout, f.opts.Resolver)
+	nt.MaxResponseHeaderBytes = f.opts.MaxHeaderBytes
+	t, _ := f.transports.LoadOrStore(p.String(), nt)
+	return t.(*http.Transport)
+}
+
+func (f *forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.slots != nil {
+		select {
+		case f.slots <- struct{}{}:
+			defer func() { <-f.slots }()
+		default:
+			w.Header().Set("Retry-After", saturatedRetryAfter)
+			writeError(w, http.StatusServiceUnavailable, "too_many_in_flight", "too many forwarded requests in flight")
+			return
+		}
+	}
+	if r.Method == http.MethodConnect {
+		f.tunnel(w, r)
+		return
+	}
+	f.forwardHTTP(w, r)
+}
+
+// attempt calls try with successive upstreams, never reusing one, until try
+// succeeds or the retry budget runs out. Each outcome is reported to the
+// pool. On success it returns the upstream used, whose concurrency slot the
+// caller must Release when done. Otherwise it returns the last error, or the
+// selection error if no upstream could be selected at all.
+//
+// Once ctx is done no further upstreams are tried. A deadline counts against
+// the upstream in use and yields errUpstreamTimeout; a cancellation means
+// the client went away and is not held against the upstream.
+func (f *forwarder) attempt(ctx context.Context, maxAttempts int, try func(upstream Proxy) error) (Proxy, error) {
+	tried := make(map[string]bool)
+	untried := func(p Proxy) bool { return !tried[p.String()] }
+
+	var lastErr error
+	for i := 0; i < maxAttempts; i++ {
+		upstream, err := f.selector.Next(untried)
+		if err != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			break
+		}
+		tried[upstream.String()] = true
+
+		start := time.Now()
+		if lastErr = try(upstream); lastErr == nil {
+			noteProxy(ctx, upstream)
+			f.pool.Report(upstream.String(), true, time.Since(start))
+			return upstream, nil
+		}
+		if errors.Is(ctx.Err(), context.Canceled) {
+			f.pool.Release(upstream.String())
+			return Proxy{}, ctx.Err()
+		}
+		f.pool.Report(upstream.String(), false, 0)
+		f.pool.Release(upstream.String())
+		if f.opts.Recheck != nil {
+			f.opts.Recheck(upstream)
+		}
+		if ctx.Err() != nil {
+			return Proxy{}, errUpstreamTimeout
+		}
+	}
+	return Proxy{}, lastErr
+}
+
+// withTimeout derives the context for one forwarded request from the
+// client's, so that the upstream side is cancelled if the client leaves.
+func (f *forwarder) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, f.opts.Timeout)
+}
+
+// upstreamStatusError reports an upstream response whose status counts as a
+// failure. If it is the final attempt, resp is relayed to the client as is.
+type upstreamStatusError struct {
+	resp *http.Response
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream returned " + e.resp.Status
+}
+
+func (f *forwarder) forwardHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := f.withTimeout(r.Context())
+	defer cancel()
+	out := r.Clone(ctx)
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	maxAttempts := 1
+	if f.opts.RetryMethods[r.Method] {
+		replayable, err := bufferBody(out)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_body", "read request body: "+err.Error())
+			return
+		}
+		if replayable {
+			maxAttempts += f.opts.Retries
+		}
+	}
+
+	var resp *http.Response
+	upstream, err := f.attempt(ctx, maxAttempts, func(upstream Proxy) error {
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+		if out.GetBody != nil {
+			out.Body, _ = out.GetBody()
+		}
+		var err error
+		resp, err = f.transport(upstream).RoundTrip(out)
+		if err != nil {
+			return err
+		}
+		if f.opts.RetryStatuses[resp.StatusCode] {
+			return &upstreamStatusError{resp: resp}
+		}
+		return nil
+	})
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		// Every attempt failed with a retryable status; relay the last one.
+		err = nil
+	}
+	if err != nil {
+		if resp != nil {
+			// A failed response held from an earlier attempt, superseded
+			// by a timeout or cancellation.
+			resp.Body.Close()
+		}
+		writeForwardError(w, err)
+		return
+	}
+	if statusErr == nil {
+		defer f.pool.Release(upstream.String())
+	}
+	defer resp.Body.Close()
+
+	limit := f.opts.MaxResponseBytes
+	if limit > 0 && resp.ContentLength > limit {
+		writeError(w, http.StatusBadGateway, "response_too_large", fmt.Sprintf("upstream response of %d bytes exceeds the %d byte limit", resp.ContentLength, limit))
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	var body io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && !acceptsGzip(r.Header) {
+		// The client cannot take the encoding the upstream chose. A client
+		// that sent no Accept-Encoding never gets here: the transport asks
+		// for gzip itself and decompresses.
+		zr, err := gzip.NewReader(resp.Body)
+		switch {
+		case errors.Is(err, io.EOF):
+			body = http.NoBody
+		case err != nil:
+			writeError(w, http.StatusBadGateway, "invalid_upstream_body", "upstream sent an invalid gzip body: "+err.Error())
+			return
+		default:
+			defer zr.Close()
+			body = zr
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// The status is already sent, so whenever the body cannot be relayed in
+	// full, cut the connection rather than let the client take a truncated
+	// body for a complete one.
+	copied := body
+	if limit > 0 {
+		copied = io.LimitReader(body, limit)
+	}
+	if _, err := io.Copy(w, copied); err != nil {
+		slog.Warn("forwarded response cut short", "url", r.URL.String(), "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if limit <= 0 {
+		return
+	}
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		slog.Warn("forwarded response truncated at size limit", "url", r.URL.String(), "limit", limit)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// bufferBody makes req's body re-readable via GetBody so the request can be
+// resent. Bodies over maxReplayBody are left streaming and reported as not
+// replayable.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxReplayBody+1))
+	if err != nil {
+		return false, err
+	}
+	if len(buf) > maxReplayBody {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), req.Body))
+		return false, nil
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+func (f *forwarder) tunnel(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "hijack_unsupported", "connection does not support hijacking")
+		return
+	}
+
+	// The timeout covers establishing the tunnel, not its lifetime.
+	ctx, cancel := f.withTimeout(r.Context())
+	defer cancel()
+	var upConn net.Conn
+	upstream, err := f.attempt(ctx, 1+f.opts.Retries, func(upstream Proxy) error {
+		var err error
+		upConn, err = dialThrough(ctx, upstream, r.Host, upstreamDialTimeout, f.opts.Resolver)
+		return err
+	})
+	if err != nil {
+		writeForwardError(w, err)
+		return
+	}
+	defer f.pool.Release(upstream.String())
+	defer upConn.Close()
+
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upConn, clientBuf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, upConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func writeForwardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client has gone; the status is only for the access log.
+		w.WriteHeader(statusClientClosed)
+	case errors.Is(err, errUpstreamTimeout):
+		writeError(w, http.StatusGatewayTimeout, errorCode(err), err.Error())
+	case errors.Is(err, errAllSaturated):
+		w.Header().Set("Retry-After", saturatedRetryAfter)
+		writeError(w, http.StatusServiceUnavailable, errorCode(err), err.Error())
+	case errors.Is(err, errNoHealthyProxies), errors.Is(err, errNoMatchingProxies):
+		writeError(w, http.StatusServiceUnavailable, errorCode(err), err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, "upstream_failed", err.Error())
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header in h allows gzip
+// responses. An explicit gzip entry takes precedence over "*".
+func acceptsGzip(h http.Header) bool {
+	var explicit, wildcard *bool
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			// q=0, q=0.0 and so on refuse the coding.
+			q, hasQ := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			ok := !hasQ || strings.Trim(q, "0.") != ""
+			switch strings.ToLower(strings.TrimSpace(coding)) {
+			case "gzip", "x-gzip":
+				explicit = &ok
+			case "*":
+				wildcard = &ok
+			}
+		}
+	}
+	if explicit != nil {
+		return *explicit
+	}
+	return wildcard != nil && *wildcard
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestForwarder(pool *ProxyPool) *forwarder {
+	return newForwarder(pool, &lruSelector{pool: pool}, forwardOptions{
+		Retries:       2,
+		RetryStatuses: map[int]bool{http.StatusBadGateway: true},
+		RetryMethods:  parseRetryMethods("GET,HEAD"),
+	})
+}
+
+func TestForwardFailsOverToHealthyUpstream(t *testing.T) {
+	mocks, proxies := startMockUpstreams(2, 0)
+	defer closeMockUpstreams(mocks)
+	mocks[0].broken.Store(true)
+	pool := NewProxyPool(proxies, PoolOptions{})
+	f := newTestForwarder(pool)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/page", nil))
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != http.StatusOK || !strings.HasPrefix(string(body), "mock-2: GET http://example.test/page") {
+			t.Fatalf("request %d = %d %q, want it answered by mock-2", i, rec.Code, body)
+		}
+	}
+	stats := pool.Stats()
+	if stats[0].Failures != mocks[0].handled.Load() || stats[1].Successes != 2 {
+		t.Errorf("stats = %+v, want every mock-1 attempt failed and 2 successes on mock-2", stats)
+	}
+	if stats[0].InFlight != 0 || stats[1].InFlight != 0 {
+		t.Errorf("stats = %+v, want every slot released", stats)
+	}
+}
+
+// recordingUpstream is an upstream proxy that records the body of every
+// request it receives and answers with status.
+type recordingUpstream struct {
+	proxy  Proxy
+	status int
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func startRecordingUpstream(t *testing.T, status int) *recordingUpstream {
+	u := &recordingUpstream{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.mu.Lock()
+		u.bodies = append(u.bodies, string(body))
+		u.mu.Unlock()
+		w.WriteHeader(u.status)
+		io.WriteString(w, "answered "+r.Method)
+	}))
+	t.Cleanup(srv.Close)
+	p, err := proxyEntry{URL: srv.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.proxy = p
+	return u
+}
+
+func (u *recordingUpstream) received() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.bodies...)
+}
+
+func TestForwardRetriesOnlyRetryableMethods(t *testing.T) {
+	mocks, proxies := startMockUpstreams(2, 0)
+	defer closeMockUpstreams(mocks)
+	mocks[0].broken.Store(true)
+	mocks[1].broken.Store(true)
+	f := newTestForwarder(NewProxyPool(proxies, PoolOptions{}))
+
+	tests := []struct {
+		method   string
+		attempts int64
+	}{
+		{http.MethodPost, 1},
+		{http.MethodGet, 2},
+	}
+	for _, tt := range tests {
+		before := mocks[0].handled.Load() + mocks[1].handled.Load()
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(tt.method, "http://example.test/page", strings.NewReader("payload")))
+		if got := mocks[0].handled.Load() + mocks[1].handled.Load() - before; got != tt.attempts {
+			t.Errorf("%s tried %d upstreams, want %d", tt.method, got, tt.attempts)
+		}
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("%s = %d, want the upstream's 502", tt.method, rec.Code)
+		}
+	}
+}
+
+func TestForwardReplaysBodyOnRetry(t *testing.T) {
+	failing := startRecordingUpstream(t, http.StatusBadGateway)
+	working := startRecordingUpstream(t, http.StatusOK)
+	pool := NewProxyPool([]Proxy{failing.proxy, working.proxy}, PoolOptions{})
+	f := newForwarder(pool, &lruSelector{pool: pool}, forwardOptions{
+		Retries:       1,
+		RetryStatuses: map[int]bool{http.StatusBadGateway: true},
+		RetryMethods:  parseRetryMethods("POST"),
+	})
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://example.test/form", strings.NewReader("a=1&b=2")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "answered POST" {
+		t.Fatalf("response = %d %q, want the working upstream's answer", rec.Code, rec.Body)
+	}
+	for _, u := range []*recordingUpstream{failing, working} {
+		if got := u.received(); len(got) != 1 || got[0] != "a=1&b=2" {
+			t.Errorf("%s received bodies %q, want the full body once", u.proxy, got)
+		}
+	}
+}
+
+func TestForwardRelaysLastRetryStatusResponse(t *testing.T) {
+	mocks, proxies := startMockUpstreams(2, 0)
+	defer closeMockUpstreams(mocks)
+	mocks[0].broken.Store(true)
+	mocks[1].broken.Store(true)
+	f := newTestForwarder(NewProxyPool(proxies, PoolOptions{}))
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/page", nil))
+	last := rec.Header().Get(mockUpstreamHeader)
+	if rec.Code != http.StatusBadGateway || last == "" {
+		t.Fatalf("response = %d from %q, want a mock's 502", rec.Code, last)
+	}
+	if body := rec.Body.String(); body != last+" failed on purpose\n" {
+		t.Errorf("body = %q, want %s's own error page", body, last)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want the upstream's text/plain rather than an error envelope", ct)
+	}
+}
+
+// startStallingUpstream starts an upstream proxy that sends head, if any,
+// as the start of a 200 response and then stalls until the test ends.
+func startStallingUpstream(t *testing.T, head string) Proxy {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if head != "" {
+			io.WriteString(w, head)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-stop:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		srv.Close()
+	})
+	p, err := proxyEntry{URL: srv.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newTimeoutForwarder(upstream Proxy) *forwarder {
+	pool := NewProxyPool([]Proxy{upstream}, PoolOptions{})
+	return newForwarder(pool, &lruSelector{pool: pool}, forwardOptions{Timeout: 50 * time.Millisecond})
+}
+
+func TestForwardTimeoutReturns504(t *testing.T) {
+	f := newTimeoutForwarder(startStallingUpstream(t, ""))
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/slow", nil))
+	assertError(t, rec, http.StatusGatewayTimeout, "upstream_timeout")
+	if stats := f.pool.Stats(); stats[0].Failures != 1 || stats[0].InFlight != 0 {
+		t.Errorf("stats = %+v, want the timeout counted as a failure and the slot released", stats[0])
+	}
+}
+
+func TestForwardTimeoutMidBodyAbortsResponse(t *testing.T) {
+	// Big enough that the status and part of the body reach the client
+	// before the timeout.
+	head := strings.Repeat("x", 64<<10)
+	f := newTimeoutForwarder(startStallingUpstream(t, head))
+	svc := httptest.NewServer(f)
+	defer svc.Close()
+	svcURL, _ := url.Parse(svc.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(svcURL)}}
+
+	resp, err := client.Get("http://example.test/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("read %d bytes to a clean end, want the truncated response aborted", len(body))
+	}
+	if resp.StatusCode != http.StatusOK || len(body) > len(head) {
+		t.Errorf("got %d with %d body bytes, want 200 and at most the %d sent", resp.StatusCode, len(body), len(head))
+	}
+}
+
+// startUpstream starts an upstream proxy that answers every request with h.
+func startUpstream(t *testing.T, h http.HandlerFunc) Proxy {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	p, err := proxyEntry{URL: srv.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// newLimitedForwarder returns a forwarder over upstream alone with opts.
+func newLimitedForwarder(upstream Proxy, opts forwardOptions) *forwarder {
+	pool := NewProxyPool([]Proxy{upstream}, PoolOptions{})
+	return newForwarder(pool, &lruSelector{pool: pool}, opts)
+}
+
+func TestForwardMaxResponseBytes(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	sized := startUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	})
+	// Flushing first leaves the length unknown, so the body is chunked.
+	streamed := startUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body)
+	})
+
+	rec := httptest.NewRecorder()
+	newLimitedForwarder(sized, forwardOptions{MaxResponseBytes: 10}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/", nil))
+	assertError(t, rec, http.StatusBadGateway, "response_too_large")
+
+	rec = httptest.NewRecorder()
+	newLimitedForwarder(streamed, forwardOptions{MaxResponseBytes: int64(len(body))}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("streamed body at the limit = %d with %d bytes, want all %d", rec.Code, rec.Body.Len(), len(body))
+	}
+
+	svc := httptest.NewServer(newLimitedForwarder(streamed, forwardOptions{MaxResponseBytes: 10}))
+	defer svc.Close()
+	svcURL, _ := url.Parse(svc.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(svcURL)}}
+	// The head of the response is small enough to still be buffered when
+	// the connection is cut, so the client may see no response at all.
+	resp, err := client.Get("http://example.test/")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Fatalf("read %d bytes to a clean end, want the oversized response aborted", len(got))
+	}
+	if len(got) > 10 {
+		t.Errorf("relayed %d body bytes past the 10 byte limit", len(got))
+	}
+}
+
+func TestForwardMaxHeaderBytes(t *testing.T) {
+	upstream := startUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Big", strings.Repeat("x", 8<<10))
+	})
+	f := newLimitedForwarder(upstream, forwardOptions{MaxHeaderBytes: 1 << 10})
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/", nil))
+	assertError(t, rec, http.StatusBadGateway, "upstream_failed")
+	if stats := f.pool.Stats(); stats[0].InFlight != 0 {
+		t.Errorf("stats = %+v, want the slot released", stats[0])
+	}
+}
+
+func TestForwardMaxInFlight(t *testing.T) {
+	mocks, proxies := startMockUpstreams(1, 0)
+	defer closeMockUpstreams(mocks)
+	f := newLimitedForwarder(proxies[0], forwardOptions{MaxInFlight: 1})
+
+	// Hold the only slot as a request in flight would.
+	f.slots <- struct{}{}
+	for _, target := range []string{"http://example.test/", "example.test:443"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if !strings.HasPrefix(target, "http") {
+			req = httptest.NewRequest(http.MethodConnect, "http://"+target, nil)
+		}
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		assertError(t, rec, http.StatusServiceUnavailable, "too_many_in_flight")
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s %s: 503 without Retry-After", req.Method, target)
+		}
+	}
+	if mocks[0].handled.Load() != 0 {
+		t.Error("a request over the limit reached the upstream")
+	}
+
+	<-f.slots
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("with the slot free = %d %s, want 200", rec.Code, rec.Body)
+	}
+}
+
+// startIPv6Mock starts a mock upstream on [::1], skipping the test where
+// IPv6 loopback is unavailable. The pool entry is parsed from its URL as a
+// config entry would be.
+func startIPv6Mock(t *testing.T) (*mockUpstream, Proxy) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	m := &mockUpstream{name: "mock-v6"}
+	m.srv = httptest.NewUnstartedServer(m)
+	m.srv.Listener.Close()
+	m.srv.Listener = ln
+	m.srv.Start()
+	t.Cleanup(m.srv.Close)
+
+	p, err := proxyEntry{URL: "http://" + ln.Addr().String()}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, p
+}
+
+func TestIPv6UpstreamHealthCheckAndForward(t *testing.T) {
+	m, upstream := startIPv6Mock(t)
+	if upstream.Host != "::1" || !strings.HasPrefix(upstream.String(), "http://[::1]:") {
+		t.Fatalf("parsed upstream = %s, want host ::1 in brackets", upstream)
+	}
+	pool := NewProxyPool([]Proxy{upstream}, PoolOptions{})
+
+	checker := NewHealthChecker(pool, healthOptions{CheckURL: "http://check.test/ip", Expect: "mock-v6", Timeout: time.Second, Interval: time.Minute})
+	m.broken.Store(true)
+	checker.CheckAll(context.Background())
+	if pool.Stats()[0].Healthy {
+		t.Fatal("broken IPv6 upstream passed its health check")
+	}
+	m.broken.Store(false)
+	checker.CheckAll(context.Background())
+	if !pool.Stats()[0].Healthy {
+		t.Fatal("IPv6 upstream failed its health check")
+	}
+
+	rec := httptest.NewRecorder()
+	newTestForwarder(pool).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.test/page", nil))
+	if body := rec.Body.String(); rec.Code != http.StatusOK || body != "mock-v6: GET http://example.test/page\n" {
+		t.Fatalf("forwarded response = %d %q", rec.Code, body)
+	}
+}
+
+func TestIPv6TunnelToIPv6Target(t *testing.T) {
+	_, upstream := startIPv6Mock(t)
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret page")
+	}))
+	target.Listener.Close()
+	target.Listener = ln
+	target.StartTLS()
+	defer target.Close()
+
+	svc := httptest.NewServer(newTestForwarder(NewProxyPool([]Proxy{upstream}, PoolOptions{})))
+	defer svc.Close()
+	hc := target.Client()
+	svcURL, _ := url.Parse(svc.URL)
+	hc.Transport.(*http.Transport).Proxy = http.ProxyURL(svcURL)
+
+	resp, err := hc.Get(target.URL) // https://[::1]:port
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secret page" {
+		t.Fatalf("body = %q, want the target's page through the tunnel", body)
+	}
+}
+
+// startGzipUpstream starts an upstream proxy that answers every request
+// itself with a gzip-compressed body, whatever the request accepts.
+func startGzipUpstream(t *testing.T, body string) Proxy {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, body)
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write(compressed.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	p, err := proxyEntry{URL: srv.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestForwardContentEncoding(t *testing.T) {
+	const page = "<html>compressible page</html>"
+	f := newTestForwarder(NewProxyPool([]Proxy{startGzipUpstream(t, page)}, PoolOptions{}))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"gzip passed through", "gzip, deflate", true},
+		{"wildcard passed through", "*", true},
+		{"no encoding requested", "", false},
+		{"identity only", "identity", false},
+		{"gzip refused", "br, gzip;q=0, *", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.test/page", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+
+			body := rec.Body.Bytes()
+			if got := rec.Header().Get("Content-Encoding"); (got == "gzip") != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip: %v", got, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+					t.Errorf("Content-Length = %s for a %d byte body", cl, len(body))
+				}
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != page {
+				t.Errorf("body = %q, want %q", body, page)
+			}
+		})
+	}
+}
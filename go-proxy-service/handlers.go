@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// saturatedRetryAfter is the Retry-After hint, in seconds, sent when every
+// matching proxy is at its concurrency limit.
+const saturatedRetryAfter = "1"
+
+var errAllExcluded = errors.New("every usable proxy matching the request is excluded")
+
+type server struct {
+	pool     *ProxyPool
+	selector Selector
+	checker  *HealthChecker
+
+	// hideCredentials strips upstream credentials from /get-proxy
+	// responses.
+	hideCredentials bool
+	// serveMetrics exposes /metrics on the API listener.
+	serveMetrics bool
+	sessions     *sessionCache
+	// admin, when set, is required for the /proxies endpoints.
+	admin *apiKeyAuth
+	// requireKeys is set when every request must carry an API key.
+	requireKeys bool
+	events      *eventHub
+	// eventsOrigins are the cross-origin pages allowed to subscribe to
+	// /events, keyed by lower-case origin; "*" allows any.
+	eventsOrigins map[string]bool
+	// leases, when set, wraps every /get-proxy handout in a lease.
+	leases *leaseTable
+	// forward, when set, handles proxy-form requests (absolute URLs and
+	// CONNECT) arriving on the API listener.
+	forward http.Handler
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get-proxy", s.handleGetProxy)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	mux.HandleFunc("POST /report", s.handleReport)
+	mux.HandleFunc("POST /ban", s.handleBan)
+	mux.HandleFunc("POST /release", s.handleRelease)
+	mux.HandleFunc("GET /events", s.handleEvents)
+	mux.Handle("GET /proxies", s.adminOnly(s.handleListProxies))
+	mux.Handle("POST /proxies", s.adminOnly(s.handleAddProxy))
+	mux.Handle("DELETE /proxies/{id}", s.adminOnly(s.handleRemoveProxy))
+	mux.Handle("POST /check", s.adminOnly(s.handleCheck))
+	if s.serveMetrics {
+		mux.Handle("GET /metrics", promhttp.Handler())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.forward != nil && isProxyRequest(r) {
+			s.forward.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &muxErrorWriter{ResponseWriter: w}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type batchResponse struct {
+	Proxies []Proxy `json:"proxies"`
+	Count   int     `json:"count"`
+}
+
+type probeResponse struct {
+	Status    string `json:"status"`
+	Available int    `json:"available,omitempty"`
+}
+
+type leaseBatchResponse struct {
+	Proxies []leaseResponse `json:"proxies"`
+	Count   int             `json:"count"`
+}
+
+// withProbes answers the load balancer probes /healthz and /readyz ahead of
+// next, so they bypass logging, rate limiting and authentication.
+func (s *server) withProbes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || isProxyRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/healthz":
+			if n := s.pool.Available(); n == 0 {
+				writeError(w, http.StatusServiceUnavailable, errorCode(errNoHealthyProxies), errNoHealthyProxies.Error())
+			} else {
+				writeJSON(w, http.StatusOK, probeResponse{Status: "ok", Available: n})
+			}
+		case "/readyz":
+			if !s.checker.Ready() {
+				writeError(w, http.StatusServiceUnavailable, "not_ready", "first health check has not completed")
+			} else {
+				writeJSON(w, http.StatusOK, probeResponse{Status: "ready"})
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// isProxyRequest reports whether r is addressed to the service as a forward
+// proxy rather than to its API.
+func isProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+func (s *server) handleGetProxy(w http.ResponseWriter, r *http.Request) {
+	getProxyRequests.Inc()
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeError(w, http.StatusNotAcceptable, "unsupported_format", err.Error())
+		return
+	}
+	if s.leases != nil && format != formatJSON {
+		// Text and CSV have nowhere to put the lease id the client needs
+		// to release the handout.
+		writeError(w, http.StatusBadRequest, "unsupported_format", "leases are only returned as JSON, which carries the lease id; ask for format=json")
+		return
+	}
+
+	q := r.URL.Query()
+	var filters []Filter
+	if c := q.Get("country"); c != "" {
+		filters = append(filters, countryFilter(c))
+	}
+	if t := q.Get("type"); t != "" {
+		scheme := strings.ToLower(t)
+		filters = append(filters, func(p Proxy) bool { return p.Scheme == scheme })
+	}
+	if tags := q["tag"]; len(tags) > 0 {
+		filters = append(filters, func(p Proxy) bool { return p.HasTags(tags) })
+	}
+	switch strings.ToLower(q.Get("scheme")) {
+	case "", "http":
+	case "https":
+		if !s.checker.ChecksHTTPS() {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", `"scheme=https" needs HTTPS health checks (-check-https-url)`)
+			return
+		}
+		filters = append(filters, s.pool.httpsFilter())
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", `"scheme" must be http or https`)
+		return
+	}
+	excluded, err := parseExclude(q["exclude"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	matching := filters
+	if len(excluded) > 0 {
+		filters = append(filters, func(p Proxy) bool { return !excluded[p.String()] })
+	}
+
+	count := 1
+	if c := q.Get("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", `"count" must be a positive integer`)
+			return
+		}
+		count = n
+	}
+
+	session := q.Get("session")
+	if session != "" && q.Has("count") {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", `"session" cannot be combined with "count"`)
+		return
+	}
+
+	var proxies []Proxy
+	if session != "" {
+		var p Proxy
+		p, err = s.sessions.Next(session, s.selector, filters, s.leases != nil)
+		proxies = []Proxy{p}
+	} else {
+		proxies, err = s.nextDistinct(count, filters)
+	}
+	// Had nothing been excluded, an available proxy would have been found.
+	if (errors.Is(err, errNoMatchingProxies) || errors.Is(err, errNoHealthyProxies)) &&
+		len(excluded) > 0 && s.pool.Available(matching...) > 0 {
+		err = errAllExcluded
+	}
+	if errors.Is(err, errAllExcluded) {
+		writeError(w, http.StatusConflict, errorCode(err), err.Error())
+		return
+	}
+	if errors.Is(err, errNoMatchingProxies) {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+	if errors.Is(err, errAllSaturated) {
+		w.Header().Set("Retry-After", saturatedRetryAfter)
+	}
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errorCode(err), err.Error())
+		return
+	}
+	for _, p := range proxies {
+		noteProxy(r.Context(), p)
+	}
+	if s.hideCredentials {
+		for i := range proxies {
+			proxies[i] = proxies[i].WithoutCredentials()
+		}
+	}
+
+	var leased []leaseResponse
+	if s.leases != nil {
+		for _, p := range proxies {
+			leased = append(leased, s.leases.Grant(p))
+		}
+	}
+
+	switch {
+	case format == formatText:
+		writeProxiesText(w, proxies)
+	case format == formatCSV:
+		writeProxiesCSV(w, proxies)
+	case leased != nil && q.Has("count"):
+		writeJSON(w, http.StatusOK, leaseBatchResponse{Proxies: leased, Count: len(leased)})
+	case leased != nil:
+		writeJSON(w, http.StatusOK, leased[0])
+	case q.Has("count"):
+		writeJSON(w, http.StatusOK, batchResponse{Proxies: proxies, Count: len(proxies)})
+	default:
+		writeJSON(w, http.StatusOK, proxies[0])
+	}
+}
+
+// nextDistinct selects up to n different proxies. It only fails if not even
+// one proxy could be selected.
+func (s *server) nextDistinct(n int, filters []Filter) ([]Proxy, error) {
+	taken := make(map[string]bool)
+	filters = append(filters, func(p Proxy) bool { return !taken[p.String()] })
+
+	var proxies []Proxy
+	for len(proxies) < n {
+		p, err := s.selector.Next(filters...)
+		if err != nil {
+			if len(proxies) == 0 {
+				return nil, err
+			}
+			break
+		}
+		taken[p.String()] = true
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// parseExclude reads the comma-separated proxy URLs of ?exclude= into a
+// set of proxy ids. Bare host:port entries mean http, as in the config.
+func parseExclude(lists []string) (map[string]bool, error) {
+	excluded := make(map[string]bool)
+	for _, list := range lists {
+		for _, raw := range strings.Split(list, ",") {
+			if raw = strings.TrimSpace(raw); raw == "" {
+				continue
+			}
+			p, err := proxyEntry{URL: raw}.toProxy()
+			if err != nil {
+				return nil, fmt.Errorf(`"exclude" entry %q: %w`, raw, err)
+			}
+			excluded[p.String()] = true
+		}
+	}
+	return excluded, nil
+}
+
+// countryFilter accepts proxies tagged with any of the comma-separated
+// country codes in list, ignoring case.
+func countryFilter(list string) Filter {
+	want := make(map[string]bool)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			want[strings.ToUpper(c)] = true
+		}
+	}
+	return func(p Proxy) bool {
+		return want[p.Country]
+	}
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.pool.Stats())
+}
+
+type reportRequest struct {
+	Proxy     string `json:"proxy"`
+	Success   *bool  `json:"success"`
+	LatencyMs int64  `json:"latency_ms"`
+	LeaseID   string `json:"lease_id"`
+	Session   string `json:"session"`
+}
+
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request) {
+	var req reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Proxy == "" || req.Success == nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", `"proxy" and "success" are required`)
+		return
+	}
+
+	err := s.pool.Report(req.Proxy, *req.Success, time.Duration(req.LatencyMs)*time.Millisecond)
+	if errors.Is(err, errUnknownProxy) {
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+		return
+	}
+	// A report means the client is done with the proxy. With leases the
+	// slot belongs to the lease, which is released if given and otherwise
+	// left to expire; a session's slot is freed once however often the
+	// session reports.
+	switch {
+	case s.leases != nil:
+		if req.LeaseID != "" {
+			s.leases.Release(req.LeaseID)
+		}
+	case req.Session != "":
+		s.sessions.Release(req.Session, req.Proxy)
+	default:
+		s.pool.Release(req.Proxy)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type releaseRequest struct {
+	LeaseID string `json:"lease_id"`
+}
+
+func (s *server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if s.leases == nil {
+		writeError(w, http.StatusNotFound, "leases_disabled", "leases are not enabled")
+		return
+	}
+	var req releaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid JSON body: "+err.Error())
+		return
+	}
+	err := s.leases.Release(req.LeaseID)
+	switch {
+	case errors.Is(err, errInvalidLease):
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+	case err != nil:
+		writeError(w, http.StatusNotFound, errorCode(err), err.Error())
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type banRequest struct {
+	Proxy    string `json:"proxy"`
+	Duration string `json:"duration"`
+}
+
+func (s *server) handleBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid JSON body: "+err.Error())
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", `"duration" must be a positive Go duration such as "10m"`)
+		return
+	}
+	if err := s.pool.Ban(req.Proxy, d); err != nil {
+		writeError(w, http.StatusBadRequest, errorCode(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON sends v as a success response. Every endpoint answers through
+// writeJSON or writeError; the body is the data itself, never wrapped.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	// Code identifies the error in snake case, e.g. "no_healthy_proxies"
+	// or "rate_limited", so clients need not parse Message.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: msg}})
+}
+
+// sentinelCodes gives each sentinel error its own error-envelope code.
+var sentinelCodes = []struct {
+	err  error
+	code string
+}{
+	{errNoHealthyProxies, "no_healthy_proxies"},
+	{errNoMatchingProxies, "no_matching_proxies"},
+	{errAllSaturated, "all_saturated"},
+	{errAllExcluded, "all_excluded"},
+	{errUnknownProxy, "unknown_proxy"},
+	{errDuplicateProxy, "duplicate_proxy"},
+	{errUnknownLease, "unknown_lease"},
+	{errInvalidLease, "invalid_lease"},
+	{errUpstreamTimeout, "upstream_timeout"},
+}
+
+// errorCode returns the code for a sentinel error, or "error" for any
+// other.
+func errorCode(err error) string {
+	for _, c := range sentinelCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return "error"
+}
+
+// muxErrorWriter turns the plain-text 404 and 405 answers of http.ServeMux
+// for unknown routes into regular JSON errors.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (w *muxErrorWriter) WriteHeader(status int) {
+	if status < 400 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.Header().Del("X-Content-Type-Options")
+	text := strings.ToLower(http.StatusText(status))
+	writeError(w.ResponseWriter, status, strings.ReplaceAll(text, " ", "_"), text)
+	w.replaced = true
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
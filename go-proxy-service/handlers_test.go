@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns the API handler over a pool of two proxies, the
+// second of which is unhealthy. It is set up as if behind API-key auth, so
+// the admin endpoints are open to it.
+func newTestServer(t *testing.T) (http.Handler, []Proxy) {
+	srv, proxies := newTestAPI(t)
+	srv.requireKeys = true
+	return srv.routes(), proxies
+}
+
+// newTestAPI returns the server behind newTestServer, without API keys.
+func newTestAPI(t *testing.T) (*server, []Proxy) {
+	proxies := testProxies(2)
+	proxies[0].MaxConcurrent = 1
+	pool := NewProxyPool(proxies, PoolOptions{})
+	pool.MarkHealthy(proxies[1].String(), false)
+	srv := &server{
+		pool:     pool,
+		selector: &randomSelector{pool: pool},
+		checker:  NewHealthChecker(pool, healthOptions{CheckURL: "http://check.test/", Timeout: time.Second}),
+		sessions: newSessionCache(pool, time.Minute),
+	}
+	srv.forward = newTestForwarder(pool)
+	return srv, proxies
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"bad count", "GET", "/get-proxy?count=0", "", 400, "invalid_parameter"},
+		{"bad scheme", "GET", "/get-proxy?scheme=ftp", "", 400, "invalid_parameter"},
+		{"https without checks", "GET", "/get-proxy?scheme=https", "", 400, "invalid_parameter"},
+		{"session with count", "GET", "/get-proxy?session=a&count=2", "", 400, "invalid_parameter"},
+		{"bad exclude", "GET", "/get-proxy?exclude=http://a", "", 400, "invalid_parameter"},
+		{"unsupported format", "GET", "/get-proxy?format=xml", "", 406, "unsupported_format"},
+		{"no country match", "GET", "/get-proxy?country=ZZ", "", 404, "no_matching_proxies"},
+		{"healthy proxy excluded", "GET", "/get-proxy?exclude=http://10.0.0.1:3000", "", 409, "all_excluded"},
+		{"every proxy excluded", "GET", "/get-proxy?exclude=http://10.0.0.1:3000&exclude=http://10.0.0.1:3001", "", 409, "all_excluded"},
+		{"report bad json", "POST", "/report", "{", 400, "invalid_json"},
+		{"report missing fields", "POST", "/report", `{"proxy": "http://10.0.0.1:3000"}`, 400, "invalid_parameter"},
+		{"report unknown proxy", "POST", "/report", `{"proxy": "http://10.9.9.9:1", "success": true}`, 404, "unknown_proxy"},
+		{"ban bad duration", "POST", "/ban", `{"proxy": "http://10.0.0.1:3000", "duration": "soon"}`, 400, "invalid_parameter"},
+		{"ban unknown proxy", "POST", "/ban", `{"proxy": "http://10.9.9.9:1", "duration": "1m"}`, 400, "unknown_proxy"},
+		{"release without leases", "POST", "/release", `{"lease_id": "x"}`, 404, "leases_disabled"},
+		{"add invalid proxy", "POST", "/proxies", `{"url": "ftp://10.0.0.9:21"}`, 400, "invalid_proxy"},
+		{"add duplicate proxy", "POST", "/proxies", `{"url": "http://10.0.0.1:3000"}`, 409, "duplicate_proxy"},
+		{"remove unknown proxy", "DELETE", "/proxies/http%3A%2F%2F10.9.9.9%3A1", "", 404, "unknown_proxy"},
+		{"events without upgrade", "GET", "/events", "", 400, "websocket_upgrade_failed"},
+		{"unknown route", "GET", "/nope", "", 404, "not_found"},
+		{"wrong method", "GET", "/report", "", 405, "method_not_allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestServer(t)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			assertError(t, rec, tt.status, tt.code)
+		})
+	}
+}
+
+func TestErrorResponsesFromMiddlewareAndLimits(t *testing.T) {
+	h, proxies := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	newAPIKeyAuth([]string{"secret"}).Middleware(h).ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	assertError(t, rec, http.StatusUnauthorized, "invalid_api_key")
+
+	limited := newIPRateLimiter(1, 1, 10, false).Middleware(h)
+	limited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil))
+	rec = httptest.NewRecorder()
+	limited.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	assertError(t, rec, http.StatusTooManyRequests, "rate_limited")
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	// proxies[0] allows one handout at a time and is the only healthy one.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/get-proxy", nil))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy", nil))
+	assertError(t, rec, http.StatusServiceUnavailable, "all_saturated")
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("saturated %s answered without Retry-After", proxies[0])
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.test/", nil))
+	assertError(t, rec, http.StatusServiceUnavailable, "all_saturated")
+}
+
+func TestAdminEndpointsWithoutKeys(t *testing.T) {
+	tests := []struct {
+		method, target, body string
+		admin                *apiKeyAuth
+		header               string
+		want                 int
+	}{
+		{"POST", "/proxies", `{"url": "http://10.0.0.9:3128"}`, nil, "", http.StatusForbidden},
+		{"DELETE", "/proxies/http%3A%2F%2F10.0.0.1%3A3000", "", nil, "", http.StatusForbidden},
+		{"POST", "/check", "", nil, "", http.StatusForbidden},
+		{"GET", "/proxies", "", nil, "", http.StatusOK},
+		{"POST", "/proxies", `{"url": "http://10.0.0.9:3128"}`, newAPIKeyAuth([]string{"adm"}), "", http.StatusUnauthorized},
+		{"POST", "/proxies", `{"url": "http://10.0.0.9:3128"}`, newAPIKeyAuth([]string{"adm"}), "adm", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		srv, _ := newTestAPI(t)
+		srv.admin = tt.admin
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.header != "" {
+			req.Header.Set("X-API-Key", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		srv.routes().ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s (admin keys %v, key %q) = %d %s, want %d", tt.method, tt.target, tt.admin != nil, tt.header, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestProbesBypassAuthAndRateLimits(t *testing.T) {
+	srv, _ := newTestAPI(t)
+	protected := newIPRateLimiter(1, 1, 10, false).Middleware(newAPIKeyAuth([]string{"secret"}).Middleware(srv.routes()))
+	h := srv.withProbes(protected)
+
+	// The first health check has not run, so /readyz answers 503.
+	probes := map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable}
+	for i := 0; i < 3; i++ {
+		for _, method := range []string{"GET", "HEAD"} {
+			for target, want := range probes {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+				if rec.Code != want {
+					t.Errorf("%s %s #%d without a key = %d %s, want %d", method, target, i+1, rec.Code, rec.Body, want)
+				}
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	assertError(t, rec, http.StatusUnauthorized, "invalid_api_key")
+}
+
+func TestSuccessResponseIsUnwrapped(t *testing.T) {
+	h, proxies := newTestServer(t)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy", nil))
+
+	var p Proxy
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /get-proxy = %d %s", rec.Code, rec.Body)
+	}
+	if p.String() != proxies[0].String() {
+		t.Errorf("got %s, want %s", p, proxies[0])
+	}
+}
+
+func TestGetProxyCount(t *testing.T) {
+	h, proxies := newTestServer(t)
+
+	// Only one of the two test proxies is healthy.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?count=5", nil))
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("count=5 = %d %s", rec.Code, rec.Body)
+	}
+	var batch batchResponse
+	json.Unmarshal(rec.Body.Bytes(), &batch)
+	if len(body) != 2 || body["proxies"] == nil || batch.Count != 1 || len(batch.Proxies) != 1 || batch.Proxies[0].String() != proxies[0].String() {
+		t.Errorf("count=5 = %s, want {\"proxies\": [%s], \"count\": 1}", rec.Body, proxies[0])
+	}
+
+	// Even a batch of one keeps the batch shape.
+	h, _ = newTestServer(t)
+	if got := getBatch(t, h, "/get-proxy?count=1"); len(got) != 1 {
+		t.Errorf("count=1 = %v, want a batch of one", got)
+	}
+}
+
+func TestSessionRepeatHitsShareOneSlot(t *testing.T) {
+	h, proxies := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?session=s1", nil))
+		var p Proxy
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || p.String() != proxies[0].String() {
+			t.Fatalf("hit %d = %d %s, want %s", i+1, rec.Code, rec.Body, proxies[0])
+		}
+	}
+
+	if n := inFlight(t, h); n != 1 {
+		t.Errorf("in_flight = %d after three hits of one session, want 1", n)
+	}
+}
+
+func TestSessionReportsReleaseTheSlotOnce(t *testing.T) {
+	h, proxies := newTestServer(t)
+	report := `{"proxy": "` + proxies[0].String() + `", "success": true, "session": "s1"}`
+	steps := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"GET", "/get-proxy?session=s1", "", 1},
+		{"POST", "/report", report, 0},
+		{"GET", "/get-proxy?session=s1", "", 1},
+		{"POST", "/report", report, 0},
+		// Another client takes the free slot; a further report of the
+		// session must not free it.
+		{"GET", "/get-proxy", "", 1},
+		{"POST", "/report", report, 1},
+	}
+	for i, st := range steps {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(st.method, st.target, strings.NewReader(st.body)))
+		if rec.Code >= 300 {
+			t.Fatalf("step %d: %s %s = %d %s", i+1, st.method, st.target, rec.Code, rec.Body)
+		}
+		if n := inFlight(t, h); n != st.want {
+			t.Errorf("step %d: in_flight = %d after %s %s, want %d", i+1, n, st.method, st.target, st.want)
+		}
+	}
+
+	// proxies[0] allows one handout at a time, so while the other client
+	// holds it the session cannot be served.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?session=s1", nil))
+	assertError(t, rec, http.StatusServiceUnavailable, "all_saturated")
+}
+
+func TestSessionExpiresAfterTTL(t *testing.T) {
+	srv, _ := newStickyTestAPI(t, 50*time.Millisecond)
+	h := srv.routes()
+
+	first := getProxy(t, h, "/get-proxy?session=s1")
+	if p := getProxy(t, h, "/get-proxy?session=s1"); p.String() != first.String() {
+		t.Fatalf("repeat hit = %s, want bound %s", p, first)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// The least recently used proxy is the one the session was not bound to.
+	if p := getProxy(t, h, "/get-proxy?session=s1"); p.String() == first.String() {
+		t.Fatalf("hit after the TTL = %s, want a new binding", p)
+	}
+	if n := slotsHeld(srv.pool, first.String()); n != 0 {
+		t.Errorf("expired binding still holds %d slot(s) on %s", n, first)
+	}
+}
+
+func TestSessionRebindsWhenProxyTurnsUnhealthy(t *testing.T) {
+	srv, _ := newStickyTestAPI(t, time.Minute)
+	h := srv.routes()
+
+	first := getProxy(t, h, "/get-proxy?session=s1")
+	srv.pool.MarkHealthy(first.String(), false)
+	second := getProxy(t, h, "/get-proxy?session=s1")
+	if second.String() == first.String() {
+		t.Fatalf("hit after %s turned unhealthy returned it again", first)
+	}
+	if n := slotsHeld(srv.pool, first.String()); n != 0 {
+		t.Errorf("old binding still holds %d slot(s) on %s", n, first)
+	}
+
+	// The new binding sticks once the old proxy recovers.
+	srv.pool.MarkHealthy(first.String(), true)
+	if p := getProxy(t, h, "/get-proxy?session=s1"); p.String() != second.String() {
+		t.Errorf("hit after recovery = %s, want rebound %s", p, second)
+	}
+}
+
+func TestBannedProxyReturnsAfterBan(t *testing.T) {
+	srv, proxies := newStickyTestAPI(t, time.Minute)
+	h := srv.routes()
+	banned := proxies[0].String()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/ban", strings.NewReader(`{"proxy": "`+banned+`", "duration": "50ms"}`)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /ban = %d %s", rec.Code, rec.Body)
+	}
+	if got := getBatch(t, h, "/get-proxy?count=2"); len(got) != 1 || got[0].String() == banned {
+		t.Fatalf("during the ban /get-proxy?count=2 = %v, want only %s", got, proxies[1])
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := getBatch(t, h, "/get-proxy?count=2"); len(got) != 2 {
+		t.Fatalf("after the ban /get-proxy?count=2 = %v, want both proxies", got)
+	}
+}
+
+func TestGetProxyTypeFilter(t *testing.T) {
+	srv, proxies := newFilterTestAPI(t)
+	h := srv.routes()
+
+	if got := getBatch(t, h, "/get-proxy?type=socks5&count=4"); len(got) != 1 || got[0].String() != proxies[2].String() {
+		t.Errorf("type=socks5 = %v, want only %s", got, proxies[2])
+	}
+	got := getBatch(t, h, "/get-proxy?type=HTTP&count=4")
+	for _, p := range got {
+		if p.Scheme != schemeHTTP {
+			t.Errorf("type=HTTP returned %s", p)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("type=HTTP = %v, want the 3 HTTP proxies", got)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?type=socks4", nil))
+	assertError(t, rec, http.StatusNotFound, "no_matching_proxies")
+}
+
+func TestGetProxyExcludeWithFilters(t *testing.T) {
+	srv, proxies := newFilterTestAPI(t)
+	h := srv.routes()
+
+	// proxies[0] and proxies[1] are the US mobile proxies.
+	for i := 0; i < 3; i++ {
+		p := getProxy(t, h, "/get-proxy?country=us&tag=mobile&exclude="+proxies[0].String())
+		if p.String() != proxies[1].String() {
+			t.Fatalf("hit %d = %s, want the remaining match %s", i+1, p, proxies[1])
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?country=US&tag=search&exclude="+proxies[1].String(), nil))
+	assertError(t, rec, http.StatusConflict, "all_excluded")
+}
+
+func TestGetProxySchemeFilter(t *testing.T) {
+	srv, proxies := newFilterTestAPI(t)
+	srv.checker = NewHealthChecker(srv.pool, healthOptions{CheckURL: "http://check.test/", HTTPSURL: "https://check.test/", Timeout: time.Second})
+	// proxies[2] and proxies[3] have not been checked for HTTPS yet.
+	srv.pool.MarkHTTPSHealthy(proxies[0].String(), false)
+	srv.pool.MarkHTTPSHealthy(proxies[1].String(), true)
+	h := srv.routes()
+
+	tests := []struct {
+		query string
+		want  []Proxy
+	}{
+		{"scheme=http", proxies},
+		{"scheme=https", proxies[1:]},
+		{"scheme=HTTPS&country=US", proxies[1:2]},
+	}
+	for _, tt := range tests {
+		got := make(map[string]bool)
+		for _, p := range getBatch(t, h, "/get-proxy?count=4&"+tt.query) {
+			got[p.String()] = true
+		}
+		ok := len(got) == len(tt.want)
+		for _, p := range tt.want {
+			ok = ok && got[p.String()]
+		}
+		if !ok {
+			t.Errorf("%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// newFilterTestAPI returns a test server over four healthy proxies that
+// differ in protocol, country and tags.
+func newFilterTestAPI(t *testing.T) (*server, []Proxy) {
+	srv, _ := newTestAPI(t)
+	proxies := []Proxy{
+		{Scheme: schemeHTTP, Host: "10.0.0.1", Port: 3000, Country: "US", Tags: []string{"mobile"}},
+		{Scheme: schemeHTTP, Host: "10.0.0.1", Port: 3001, Country: "US", Tags: []string{"mobile", "search"}},
+		{Scheme: schemeSOCKS5, Host: "10.0.0.2", Port: 1080, Country: "DE", Tags: []string{"mobile"}},
+		{Scheme: schemeHTTP, Host: "10.0.0.1", Port: 3003, Country: "DE"},
+	}
+	for i := range proxies {
+		proxies[i].Weight = defaultWeight
+	}
+	srv.pool = NewProxyPool(proxies, PoolOptions{})
+	srv.selector = &lruSelector{pool: srv.pool}
+	srv.sessions = newSessionCache(srv.pool, time.Minute)
+	return srv, proxies
+}
+
+// newStickyTestAPI returns a test server whose two proxies are both
+// healthy, selected least recently used first, with sessions lasting ttl.
+func newStickyTestAPI(t *testing.T, ttl time.Duration) (*server, []Proxy) {
+	srv, proxies := newTestAPI(t)
+	srv.pool.MarkHealthy(proxies[1].String(), true)
+	srv.selector = &lruSelector{pool: srv.pool}
+	srv.sessions = newSessionCache(srv.pool, ttl)
+	return srv, proxies
+}
+
+// getProxy requests target, which must answer with a single proxy.
+func getProxy(t *testing.T, h http.Handler, target string) Proxy {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	var p Proxy
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body)
+	}
+	return p
+}
+
+// getBatch requests target, which must answer with a batch of proxies.
+func getBatch(t *testing.T, h http.Handler, target string) []Proxy {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	var batch batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &batch); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", target, rec.Code, rec.Body)
+	}
+	if batch.Count != len(batch.Proxies) {
+		t.Errorf("GET %s: count %d for %d proxies", target, batch.Count, len(batch.Proxies))
+	}
+	return batch.Proxies
+}
+
+// slotsHeld returns the in-flight count of the proxy identified by id.
+func slotsHeld(pool *ProxyPool, id string) int {
+	for _, st := range pool.Stats() {
+		if st.Proxy == id {
+			return st.InFlight
+		}
+	}
+	return -1
+}
+
+// inFlight returns the in_flight count of the first proxy in /stats.
+func inFlight(t *testing.T, h http.Handler) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats []ProxyStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats[0].InFlight
+}
+
+// assertError checks that rec holds an error envelope with status and code.
+func assertError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("status = %d, want %d (body %s)", rec.Code, status, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q is not an error envelope: %v", rec.Body, err)
+	}
+	e := body["error"]
+	if len(body) != 1 || len(e) != 2 || e["code"] != code || e["message"] == "" {
+		t.Errorf("body = %s, want {\"error\": {\"code\": %q, \"message\": ...}}", rec.Body, code)
+	}
+}
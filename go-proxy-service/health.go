@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthOptions configures a HealthChecker.
+type healthOptions struct {
+	// CheckURL is requested through each proxy; a 200 marks it healthy.
+	CheckURL string
+	// HTTPSURL, if set, is an https:// URL also requested through each
+	// proxy so that HTTPS tunnelling is tracked separately from plain HTTP.
+	HTTPSURL string
+	// Expect, if set, must appear in the check response body, so that a
+	// captive portal answering 200 is not mistaken for a working proxy.
+	// "{host}" in it is replaced by the host of the proxy being checked.
+	Expect string
+	// Resolver, if set, replaces the system resolver for reaching proxies.
+	Resolver *net.Resolver
+	Timeout  time.Duration
+	Interval time.Duration
+	// Concurrency caps how many proxies are checked at once; zero means
+	// defaultCheckConcurrency.
+	Concurrency int
+}
+
+// defaultCheckConcurrency is the check concurrency when none is configured.
+const defaultCheckConcurrency = 32
+
+// maxCheckBody bounds how much of a check response is searched for
+// healthOptions.Expect.
+const maxCheckBody = 1 << 20
+
+// HealthChecker periodically sends a test request through every proxy in
+// the pool and marks each one healthy or unhealthy.
+type HealthChecker struct {
+	pool *ProxyPool
+	opts healthOptions
+
+	// ready is set once the first full check cycle has completed.
+	ready atomic.Bool
+	// mu guards running, the cycle in progress if any.
+	mu      sync.Mutex
+	running *checkCycle
+	// rechecks holds the ids of proxies with a Recheck in progress.
+	rechecks sync.Map
+}
+
+func NewHealthChecker(pool *ProxyPool, opts healthOptions) *HealthChecker {
+	return &HealthChecker{pool: pool, opts: opts}
+}
+
+// ChecksHTTPS reports whether proxies are also checked for HTTPS.
+func (h *HealthChecker) ChecksHTTPS() bool {
+	return h.opts.HTTPSURL != ""
+}
+
+// Run checks the pool immediately and then once per interval until ctx is
+// cancelled.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.CheckAll(ctx)
+		if ctx.Err() == nil {
+			h.ready.Store(true)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready reports whether at least one full check cycle has completed.
+func (h *HealthChecker) Ready() bool {
+	return h.ready.Load()
+}
+
+// checkResult is the outcome of health-checking one proxy.
+type checkResult struct {
+	Proxy   Proxy
+	Latency time.Duration
+	Err     error
+	// HTTPSErr is the result of the HTTPS check, when one is configured.
+	HTTPSErr error
+}
+
+// checkCycle is one CheckAll pass, shared with callers that ask for a pass
+// while it runs.
+type checkCycle struct {
+	done    chan struct{}
+	results []checkResult // nil if the pass was cancelled
+}
+
+// CheckAll tests every proxy in the pool, records the results and returns
+// them. Results arriving after ctx is cancelled are discarded. If a pass is
+// already running, scheduled or not, CheckAll waits for it and returns its
+// results instead of starting another.
+func (h *HealthChecker) CheckAll(ctx context.Context) []checkResult {
+	h.mu.Lock()
+	if c := h.running; c != nil {
+		h.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.results
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	c := &checkCycle{done: make(chan struct{})}
+	h.running = c
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.running = nil
+		h.mu.Unlock()
+		close(c.done)
+	}()
+
+	results := h.Probe(ctx, h.pool.All())
+	for _, res := range results {
+		if ctx.Err() != nil {
+			return nil
+		}
+		h.record(res)
+	}
+	c.results = results
+	return results
+}
+
+// Recheck schedules an immediate out-of-cycle check of one proxy, e.g. after
+// it failed a forwarded request. Rechecks already pending for the same proxy
+// are not duplicated.
+func (h *HealthChecker) Recheck(proxy Proxy) {
+	id := proxy.String()
+	if _, pending := h.rechecks.LoadOrStore(id, struct{}{}); pending {
+		return
+	}
+	go func() {
+		defer h.rechecks.Delete(id)
+		h.record(h.Probe(context.Background(), []Proxy{proxy})[0])
+	}()
+}
+
+func (h *HealthChecker) record(res checkResult) {
+	id := res.Proxy.String()
+	if res.Err != nil {
+		slog.Warn("proxy unhealthy", "proxy", id, "error", res.Err)
+		healthCheckFailures.WithLabelValues(id).Inc()
+	} else {
+		h.pool.RecordCheckLatency(id, res.Latency)
+	}
+	h.pool.MarkHealthy(id, res.Err == nil)
+
+	if h.ChecksHTTPS() {
+		if res.HTTPSErr != nil {
+			slog.Warn("proxy unhealthy for https", "proxy", id, "error", res.HTTPSErr)
+		}
+		h.pool.MarkHTTPSHealthy(id, res.HTTPSErr == nil)
+	}
+}
+
+// Probe checks the proxies concurrently, at most opts.Concurrency at a time,
+// and returns the results in the same order once all checks have finished.
+func (h *HealthChecker) Probe(ctx context.Context, proxies []Proxy) []checkResult {
+	limit := h.opts.Concurrency
+	if limit <= 0 {
+		limit = defaultCheckConcurrency
+	}
+	sem := make(chan struct{}, limit)
+	results := make([]checkResult, len(proxies))
+	var wg sync.WaitGroup
+	for i, proxy := range proxies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, proxy Proxy) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			err := h.check(ctx, proxy, h.opts.CheckURL)
+			res := checkResult{Proxy: proxy, Latency: time.Since(start), Err: err}
+			if h.ChecksHTTPS() {
+				res.HTTPSErr = h.check(ctx, proxy, h.opts.HTTPSURL)
+			}
+			results[i] = res
+		}(i, proxy)
+	}
+	wg.Wait()
+	return results
+}
+
+// SelfTest requests the check URLs directly, bypassing every proxy, and
+// warns about any that fail. Without it an unreachable check target looks
+// exactly like a pool full of dead proxies.
+func (h *HealthChecker) SelfTest(ctx context.Context) {
+	dialer := &net.Dialer{Timeout: h.opts.Timeout, Resolver: h.opts.Resolver}
+	client := &http.Client{
+		Timeout:   h.opts.Timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	defer client.CloseIdleConnections()
+
+	for _, target := range []string{h.opts.CheckURL, h.opts.HTTPSURL} {
+		if target == "" {
+			continue
+		}
+		err := selfTestRequest(ctx, client, target)
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("check URL is unreachable even without a proxy; every proxy will fail its health check against it",
+				"url", target, "error", err)
+		} else if err == nil {
+			slog.Debug("check URL reachable", "url", target)
+		}
+	}
+}
+
+func selfTestRequest(ctx context.Context, client *http.Client, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthChecker) check(ctx context.Context, proxy Proxy, target string) error {
+	client := &http.Client{
+		Timeout:   h.opts.Timeout,
+		Transport: newUpstreamTransport(proxy, h.opts.Timeout, h.opts.Resolver),
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if h.opts.Expect == "" {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+	if err != nil {
+		return err
+	}
+	want := strings.ReplaceAll(h.opts.Expect, "{host}", proxy.Host)
+	if !strings.Contains(string(body), want) {
+		return fmt.Errorf("response does not contain %q", want)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckMarksBrokenMockUnhealthy(t *testing.T) {
+	mocks, proxies := startMockUpstreams(2, 0)
+	defer closeMockUpstreams(mocks)
+	mocks[1].broken.Store(true)
+	pool := NewProxyPool(proxies, PoolOptions{})
+	checker := NewHealthChecker(pool, healthOptions{CheckURL: "http://check.test/ip", Timeout: time.Second, Interval: time.Minute})
+
+	checker.CheckAll(context.Background())
+	if healthy, unhealthy := pool.HealthCounts(); healthy != 1 || unhealthy != 1 {
+		t.Fatalf("health counts = %d/%d, want 1/1", healthy, unhealthy)
+	}
+	if !pool.Stats()[0].Healthy {
+		t.Error("working mock upstream was marked unhealthy")
+	}
+}
+
+func TestCheckAllJoinsRunningPass(t *testing.T) {
+	var requests atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	upstream, err := proxyEntry{URL: slow.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := NewHealthChecker(NewProxyPool([]Proxy{upstream}, PoolOptions{}), healthOptions{CheckURL: "http://check.test/", Timeout: time.Second})
+
+	var wg sync.WaitGroup
+	results := make([][]checkResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checker.CheckAll(context.Background())
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream checked %d times, want 1 shared pass", got)
+	}
+	for i, res := range results {
+		if len(res) != 1 || res[0].Err != nil {
+			t.Errorf("caller %d got %+v, want one successful result", i, res)
+		}
+	}
+	if checker.CheckAll(context.Background()); requests.Load() != 2 {
+		t.Error("a call after the pass finished did not start a new one")
+	}
+}
+
+func TestProbeCapsConcurrency(t *testing.T) {
+	var active, peak atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+	upstream, err := proxyEntry{URL: slow.URL}.toProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies := make([]Proxy, 10)
+	for i := range proxies {
+		proxies[i] = upstream
+	}
+	checker := NewHealthChecker(nil, healthOptions{CheckURL: "http://check.test/", Timeout: time.Second, Concurrency: 3})
+
+	for i, res := range checker.Probe(context.Background(), proxies) {
+		if res.Err != nil {
+			t.Errorf("check %d: %v", i, res.Err)
+		}
+	}
+	if got := peak.Load(); got < 1 || got > 3 {
+		t.Errorf("peak concurrent checks = %d, want at most 3", got)
+	}
+}
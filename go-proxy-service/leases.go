@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownLease = errors.New("lease is unknown or has expired")
+	errInvalidLease = errors.New("lease id must be 32 hexadecimal characters")
+)
+
+// leaseSweepInterval is how often expired leases are given back.
+const leaseSweepInterval = time.Second
+
+// leaseTable tracks proxies handed out by /get-proxy until the client
+// releases them or their lease runs out. Each lease holds one of its
+// proxy's concurrency slots, which is freed exactly once either way.
+type leaseTable struct {
+	pool *ProxyPool
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	leases map[string]lease
+}
+
+type lease struct {
+	proxy   string
+	expires time.Time
+}
+
+// leaseResponse is a /get-proxy result when leases are enabled.
+type leaseResponse struct {
+	Proxy     Proxy     `json:"proxy"`
+	LeaseID   string    `json:"lease_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newLeaseTable(pool *ProxyPool, ttl time.Duration) *leaseTable {
+	return &leaseTable{pool: pool, ttl: ttl, leases: make(map[string]lease)}
+}
+
+// Grant opens a lease on an already handed-out proxy.
+func (t *leaseTable) Grant(p Proxy) leaseResponse {
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	expires := time.Now().Add(t.ttl)
+
+	t.mu.Lock()
+	t.leases[id] = lease{proxy: p.String(), expires: expires}
+	t.mu.Unlock()
+	return leaseResponse{Proxy: p, LeaseID: id, ExpiresAt: expires}
+}
+
+// Release ends the lease early and frees its slot. Expired leases are left
+// for Run to free.
+func (t *leaseTable) Release(id string) error {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return errInvalidLease
+	}
+
+	t.mu.Lock()
+	l, ok := t.leases[id]
+	if !ok || time.Now().After(l.expires) {
+		t.mu.Unlock()
+		return errUnknownLease
+	}
+	delete(t.leases, id)
+	t.mu.Unlock()
+
+	t.pool.Release(l.proxy)
+	return nil
+}
+
+// Run frees the slots of expired leases until ctx is cancelled.
+func (t *leaseTable) Run(ctx context.Context) {
+	ticker := time.NewTicker(leaseSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.expire(now)
+		}
+	}
+}
+
+// expire ends every lease that has run out by now and frees its slot.
+func (t *leaseTable) expire(now time.Time) {
+	var expired []string
+	t.mu.Lock()
+	for id, l := range t.leases {
+		if now.After(l.expires) {
+			delete(t.leases, id)
+			expired = append(expired, l.proxy)
+		}
+	}
+	t.mu.Unlock()
+	for _, proxy := range expired {
+		t.pool.Release(proxy)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLeaseServer returns the test API with leases of ttl enabled. Its only
+// healthy proxy allows one handout at a time, so a second lease can only be
+// granted once the first one has freed its slot.
+func newLeaseServer(t *testing.T, ttl time.Duration) (*server, http.Handler) {
+	srv, _ := newTestAPI(t)
+	srv.leases = newLeaseTable(srv.pool, ttl)
+	return srv, srv.routes()
+}
+
+// getLease asks h for a proxy and returns the lease, or the status if the
+// request did not get one.
+func getLease(t *testing.T, h http.Handler) (leaseResponse, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy", nil))
+	var l leaseResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l, rec.Code
+}
+
+func post(h http.Handler, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", target, strings.NewReader(body)))
+	return rec
+}
+
+func TestLeaseExpiryFreesSlot(t *testing.T) {
+	srv, h := newLeaseServer(t, time.Minute)
+	if _, code := getLease(t, h); code != http.StatusOK {
+		t.Fatalf("first lease = %d", code)
+	}
+	if _, code := getLease(t, h); code != http.StatusServiceUnavailable {
+		t.Fatalf("second lease while the first is held = %d, want 503", code)
+	}
+
+	srv.leases.expire(time.Now())
+	if _, code := getLease(t, h); code != http.StatusServiceUnavailable {
+		t.Fatalf("lease granted before the first one expired: %d", code)
+	}
+	srv.leases.expire(time.Now().Add(2 * time.Minute))
+	if _, code := getLease(t, h); code != http.StatusOK {
+		t.Errorf("lease after the first one expired = %d, want 200", code)
+	}
+}
+
+func TestReleaseUnknownOrExpiredLease(t *testing.T) {
+	_, h := newLeaseServer(t, 10*time.Millisecond)
+	l, code := getLease(t, h)
+	if code != http.StatusOK {
+		t.Fatalf("lease = %d", code)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	tests := []struct {
+		name, id string
+		want     int
+	}{
+		{"unknown", strings.Repeat("ab", 16), http.StatusNotFound},
+		{"expired", l.LeaseID, http.StatusNotFound},
+		{"malformed", "not-a-lease", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := post(h, "/release", `{"lease_id": "`+tt.id+`"}`); rec.Code != tt.want {
+			t.Errorf("release %s lease = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestReleaseLease(t *testing.T) {
+	_, h := newLeaseServer(t, time.Minute)
+	l, _ := getLease(t, h)
+	body := `{"lease_id": "` + l.LeaseID + `"}`
+	if rec := post(h, "/release", body); rec.Code != http.StatusNoContent {
+		t.Fatalf("release = %d %s", rec.Code, rec.Body)
+	}
+	if rec := post(h, "/release", body); rec.Code != http.StatusNotFound {
+		t.Errorf("second release of the same lease = %d, want 404", rec.Code)
+	}
+	if _, code := getLease(t, h); code != http.StatusOK {
+		t.Errorf("lease after release = %d, want 200", code)
+	}
+}
+
+func TestReportWithLeaseID(t *testing.T) {
+	_, h := newLeaseServer(t, time.Minute)
+	l, _ := getLease(t, h)
+
+	// Without lease_id the report leaves the slot to the lease.
+	report := `{"proxy": "` + l.Proxy.String() + `", "success": true`
+	if rec := post(h, "/report", report+`}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("report = %d %s", rec.Code, rec.Body)
+	}
+	if _, code := getLease(t, h); code != http.StatusServiceUnavailable {
+		t.Fatalf("lease after a report without lease_id = %d, want 503", code)
+	}
+
+	if rec := post(h, "/report", report+`, "lease_id": "`+l.LeaseID+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("report with lease_id = %d %s", rec.Code, rec.Body)
+	}
+	if _, code := getLease(t, h); code != http.StatusOK {
+		t.Errorf("lease after a report with lease_id = %d, want 200", code)
+	}
+	if rec := post(h, "/release", `{"lease_id": "`+l.LeaseID+`"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("release of a reported lease = %d, want 404", rec.Code)
+	}
+}
+
+func TestLeasesOnlyAsJSON(t *testing.T) {
+	srv, h := newLeaseServer(t, time.Minute)
+	for _, target := range []string{"/get-proxy?format=text", "/get-proxy?format=csv"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, rec.Code)
+		}
+	}
+	if stats := srv.pool.Stats(); stats[0].InFlight != 0 {
+		t.Errorf("refused requests took %d slots", stats[0].InFlight)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get-proxy?format=json", nil))
+	var l leaseResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &l); err != nil || rec.Code != http.StatusOK || l.LeaseID == "" {
+		t.Errorf("GET format=json = %d %s, want a lease", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+}
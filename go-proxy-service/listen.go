@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// validateListenAddr checks that addr is a host:port (host optional) with a
+// numeric port.
+func validateListenAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: want host:port, e.g. 127.0.0.1:8080 or :8080", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q in %q", port, addr)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("cannot resolve host %q in %q", host, addr)
+		}
+	}
+	return nil
+}
+
+// bind opens hs's listening socket up front, so a taken port is reported at
+// startup rather than from a background goroutine.
+func bind(hs *http.Server) (net.Listener, error) {
+	ln, err := net.Listen("tcp", hs.Addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("%s is already in use by another process", hs.Addr)
+	}
+	return ln, err
+}
+
+// serve serves hs on ln over TLS if it has been configured for it, plain
+// HTTP otherwise.
+func serve(hs *http.Server, ln net.Listener) error {
+	if hs.TLSConfig != nil {
+		return hs.ServeTLS(ln, "", "")
+	}
+	return hs.Serve(ln)
+}
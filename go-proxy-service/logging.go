@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Access log formats selectable with -log-format.
+const (
+	logFormatJSON     = "json"
+	logFormatCombined = "combined"
+)
+
+// newLogger returns a JSON logger writing to stderr at the named level.
+func newLogger(level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})), nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo carries per-request details that handlers fill in for the
+// access log.
+type requestInfo struct {
+	proxies []string
+}
+
+// noteProxy records an upstream proxy handed out or used for the request.
+func noteProxy(ctx context.Context, p Proxy) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.proxies = append(info.proxies, p.String())
+	}
+}
+
+// withAccessLog assigns every request an ID (reusing the client's
+// X-Request-ID if present), echoes it in the response and logs the request
+// once it completes, in the given format.
+func withAccessLog(next http.Handler, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if format == logFormatCombined {
+			os.Stdout.Write(combinedLogLine(r, rec, info, start))
+			return
+		}
+		slog.Info("request",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"host", r.Host,
+			"remote_addr", r.RemoteAddr,
+			"proxy", strings.Join(info.proxies, ","),
+			"status", rec.Status(),
+			"latency_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// combinedLogLine formats a request in NCSA Combined Log Format, followed
+// by the quoted upstream proxies ("-" if none) as an extra field.
+func combinedLogLine(r *http.Request, rec *statusRecorder, info *requestInfo, start time.Time) []byte {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	size := "-"
+	if rec.bytes > 0 {
+		size = strconv.FormatInt(rec.bytes, 10)
+	}
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	return fmt.Appendf(nil, "%s - - [%s] %s %d %s %s %s %s\n",
+		host,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(r.Method+" "+target+" "+r.Proto),
+		rec.Status(),
+		size,
+		clfQuote(r.Referer()),
+		clfQuote(r.UserAgent()),
+		clfQuote(strings.Join(info.proxies, ",")),
+	)
+}
+
+// clfQuote quotes s for a log line the way Apache does, escaping quotes,
+// backslashes and control characters; an empty s becomes "-".
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder captures the status code and body size written by a
+// handler. It passes Hijack and Flush through so CONNECT tunnels and
+// streaming still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the response status, or 200 if the handler wrote nothing.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return hj.Hijack()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCombinedLogLine(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/get-proxy?country=US", nil)
+	r.RemoteAddr = "[2001:db8::7]:51234"
+	r.Header.Set("User-Agent", `bot "v2"`)
+	rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.Write([]byte("hello"))
+	info := &requestInfo{proxies: []string{"http://10.0.0.1:3128"}}
+	start := time.Date(2026, 3, 5, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+
+	got := string(combinedLogLine(r, rec, info, start))
+	want := `2001:db8::7 - - [05/Mar/2026:13:55:36 -0700] "GET /get-proxy?country=US HTTP/1.1" 200 5 "-" "bot \"v2\"" "http://10.0.0.1:3128"` + "\n"
+	if got != want {
+		t.Errorf("combinedLogLine() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -1,25 +1,256 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	proxies := []string{
-		"http://185.217.143.123:3128",
-		"http://91.214.31.234:8080",
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+
+	cfg, flags, err := parseSettings("go-proxy-service", os.Args[1:], nil)
+	if err != nil {
+		fatal("invalid settings", "error", err)
 	}
+	logger, _ := newLogger(cfg.LogLevel)
+	slog.SetDefault(logger)
+	logSettings(flags)
+
+	proxies, source, stopMocks, err := startingProxies(cfg)
+	if err != nil {
+		fatal("failed to load proxies", "error", err)
+	}
+	defer stopMocks()
 
 	rand.Seed(time.Now().UnixNano())
 
-	http.HandleFunc("/get-proxy", func(w http.ResponseWriter, r *http.Request) {
-		proxy := proxies[rand.Intn(len(proxies))]
-		json.NewEncoder(w).Encode(map[string]string{"proxy": proxy})
+	events := newEventHub()
+	pool := NewProxyPool(proxies, PoolOptions{
+		MaxFailureRatio:  cfg.MaxFailureRatio,
+		MinReports:       cfg.MinReports,
+		QuarantineFor:    cfg.QuarantineFor,
+		Cooldown:         cfg.Cooldown,
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  cfg.BreakerCooldown,
+		WarmUp:           cfg.WarmUp,
+		Events:           events,
 	})
+	if cfg.StatePath != "" {
+		states, err := loadState(cfg.StatePath)
+		if err != nil {
+			fatal("failed to load state file", "path", cfg.StatePath, "error", err)
+		}
+		slog.Info("restored pool state", "path", cfg.StatePath, "proxies", pool.Restore(states))
+	}
+	selector, err := newSelector(cfg.Strategy, pool)
+	if err != nil {
+		fatal("invalid strategy", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+	runBackground := func(fn func(context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn(ctx)
+		}()
+	}
+
+	if cfg.ConfigPath != "" {
+		runBackground(func(ctx context.Context) { reloadOnSIGHUP(ctx, cfg.ConfigPath, pool) })
+	}
+	if cfg.StatePath != "" {
+		runBackground(func(ctx context.Context) { snapshotState(ctx, cfg.StatePath, cfg.StateInterval, pool) })
+	}
+	if source != nil {
+		runBackground(func(ctx context.Context) { source.Run(ctx, pool) })
+	}
+	resolver := newResolver(cfg.Resolver)
+	checker := NewHealthChecker(pool, healthOptions{
+		CheckURL:    cfg.CheckURL,
+		HTTPSURL:    cfg.CheckHTTPSURL,
+		Expect:      cfg.CheckExpect,
+		Resolver:    resolver,
+		Timeout:     cfg.CheckTimeout,
+		Interval:    cfg.CheckInterval,
+		Concurrency: cfg.CheckConcurrency,
+	})
+	runBackground(checker.Run)
+	if cfg.Mock == 0 {
+		// Mock upstreams answer checks themselves, so the check URL need
+		// not be reachable.
+		go checker.SelfTest(ctx)
+	}
+
+	registerMetrics(pool)
+	srv := &server{
+		pool:            pool,
+		selector:        selector,
+		checker:         checker,
+		hideCredentials: cfg.HideCredentials,
+		serveMetrics:    cfg.MetricsAddr == "",
+		sessions:        newSessionCache(pool, cfg.SessionTTL),
+		events:          events,
+		eventsOrigins:   cfg.eventsOrigins,
+	}
+	runBackground(srv.sessions.Run)
+	if cfg.LeaseTTL > 0 {
+		srv.leases = newLeaseTable(pool, cfg.LeaseTTL)
+		runBackground(srv.leases.Run)
+	}
+	if cfg.Forward || cfg.HideCredentials {
+		opts := forwardOptions{
+			Retries:       cfg.ForwardRetries,
+			RetryStatuses: cfg.retryStatuses,
+			RetryMethods:  parseRetryMethods(cfg.RetryMethods),
+			Recheck:       checker.Recheck,
+			Timeout:       cfg.ForwardTimeout,
+
+			MaxResponseBytes: cfg.MaxResponseBytes,
+			MaxHeaderBytes:   cfg.MaxHeaderBytes,
+			MaxInFlight:      cfg.MaxInFlight,
+		}
+		if cfg.ForwardResolver {
+			opts.Resolver = resolver
+		}
+		srv.forward = newForwarder(pool, selector, opts)
+	}
 
-	println("✅ Go proxy server on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	adminKeys, err := loadAPIKeys(cfg.AdminKeys, "")
+	if err != nil {
+		fatal("failed to load admin keys", "error", err)
+	}
+	if len(adminKeys) > 0 {
+		srv.admin = newAPIKeyAuth(adminKeys)
+	}
+	keys, err := loadAPIKeys(cfg.APIKeys, cfg.APIKeysFile)
+	if err != nil {
+		fatal("failed to load API keys", "error", err)
+	}
+	srv.requireKeys = len(keys) > 0
+	handler := srv.routes()
+	if srv.requireKeys {
+		// Admin keys work for the regular API too.
+		handler = newAPIKeyAuth(append(keys, adminKeys...)).Middleware(handler)
+	}
+	if cfg.RateLimit > 0 {
+		handler = newIPRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.RateClients, cfg.TrustXFF).Middleware(handler)
+	}
+	api := &http.Server{Addr: cfg.Listen, Handler: srv.withProbes(withAccessLog(handler, cfg.LogFormat))}
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		if err := configureTLS(api, cfg.TLSCert, cfg.TLSKey, cfg.TLSMinVersion, srv.forward != nil); err != nil {
+			fatal("invalid TLS settings", "error", err)
+		}
+		scheme = "https"
+	}
+	servers := []*http.Server{api}
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", promhttp.Handler())
+		servers = append(servers, &http.Server{Addr: cfg.MetricsAddr, Handler: mux})
+	}
+	listeners := make([]net.Listener, len(servers))
+	for i, hs := range servers {
+		ln, err := bind(hs)
+		if err != nil {
+			fatal("cannot listen", "addr", hs.Addr, "error", err)
+		}
+		listeners[i] = ln
+	}
+	for i, hs := range servers {
+		go func(hs *http.Server, ln net.Listener) {
+			if err := serve(hs, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("serve failed", "addr", hs.Addr, "error", err)
+			}
+		}(hs, listeners[i])
+	}
+	slog.Info("proxy server started", "addr", scheme+"://"+listeners[0].Addr().String(), "proxies", len(proxies))
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down, draining requests", "timeout", cfg.ShutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, hs := range servers {
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("shutdown incomplete", "addr", hs.Addr, "error", err)
+		}
+	}
+	background.Wait()
+	slog.Info("shutdown complete")
+}
+
+// startingProxies returns the proxies the pool starts with: -mock upstreams,
+// the provider's first list, the -config file or the built-in defaults. In
+// provider mode it also returns the source for later refreshes. stop shuts
+// down any mock upstreams.
+func startingProxies(cfg *settings) (proxies []Proxy, source *providerSource, stop func(), err error) {
+	stop = func() {}
+	switch {
+	case cfg.Mock > 0:
+		mocks, mockProxies := startMockUpstreams(cfg.Mock, cfg.MockFailRate)
+		slog.Info("mock mode, using in-process fake upstreams", "proxies", len(mockProxies), "fail_rate", cfg.MockFailRate)
+		return mockProxies, nil, func() { closeMockUpstreams(mocks) }, nil
+	case cfg.ProviderURL != "":
+		// Fetch the first list before building the pool, so the built-in
+		// defaults never serve and -state-file restores onto this list.
+		source, err = newProviderSource(cfg.ProviderURL, cfg.ProviderList, cfg.ProviderFieldMap, cfg.ProviderInterval, cfg.CheckTimeout)
+		if err != nil {
+			return nil, nil, stop, err
+		}
+		if proxies, err = source.fetch(context.Background()); err != nil {
+			return nil, nil, stop, fmt.Errorf("initial fetch from %s: %w", cfg.ProviderURL, err)
+		}
+		return proxies, source, stop, nil
+	case cfg.ConfigPath != "":
+		proxies, err = loadProxies(cfg.ConfigPath)
+		return proxies, nil, stop, err
+	default:
+		slog.Info("no config given, using built-in default proxies")
+		return defaultProxies, nil, stop, nil
+	}
+}
+
+// reloadOnSIGHUP re-reads the config file whenever the process receives
+// SIGHUP, until ctx is cancelled. A bad config is logged and the current
+// pool is kept.
+func reloadOnSIGHUP(ctx context.Context, path string, pool *ProxyPool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+		}
+
+		proxies, err := loadProxies(path)
+		if err != nil {
+			slog.Error("reload failed, keeping current pool", "error", err)
+			continue
+		}
+		pool.Replace(proxies)
+		slog.Info("reloaded config", "path", path, "proxies", len(proxies))
+	}
 }
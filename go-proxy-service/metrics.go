@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	getProxyRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_service_get_proxy_requests_total",
+		Help: "Requests served by /get-proxy.",
+	})
+	proxyHandouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_service_proxy_handouts_total",
+		Help: "Times each proxy was handed out or used for forwarding.",
+	}, []string{"proxy"})
+	healthCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_service_health_check_failures_total",
+		Help: "Failed health checks per proxy.",
+	}, []string{"proxy"})
+)
+
+// registerMetrics registers the service's collectors, including gauges that
+// read the pool's current health on every scrape.
+func registerMetrics(pool *ProxyPool) {
+	prometheus.MustRegister(
+		getProxyRequests,
+		proxyHandouts,
+		healthCheckFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "proxy_service_healthy_proxies",
+			Help: "Proxies currently passing health checks.",
+		}, func() float64 {
+			healthy, _ := pool.HealthCounts()
+			return float64(healthy)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "proxy_service_unhealthy_proxies",
+			Help: "Proxies currently failing health checks.",
+		}, func() float64 {
+			_, unhealthy := pool.HealthCounts()
+			return float64(unhealthy)
+		}),
+	)
+}
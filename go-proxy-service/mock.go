@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// mockUpstreamHeader names the mock upstream that answered a request.
+const mockUpstreamHeader = "X-Mock-Upstream"
+
+// mockUpstream is an in-process stand-in for an upstream HTTP proxy. It
+// answers plain requests itself instead of fetching them, so health checks
+// and forwarding can be exercised without network access. CONNECT requests
+// are tunnelled to the real target.
+type mockUpstream struct {
+	srv      *httptest.Server
+	name     string
+	failRate float64 // chance that a request fails with 502
+
+	// broken makes every request fail; handled counts requests received.
+	broken  atomic.Bool
+	handled atomic.Int64
+}
+
+// startMockUpstreams starts n mock upstreams and returns them along with
+// the pool entries pointing at them.
+func startMockUpstreams(n int, failRate float64) ([]*mockUpstream, []Proxy) {
+	mocks := make([]*mockUpstream, n)
+	proxies := make([]Proxy, n)
+	for i := range mocks {
+		m := &mockUpstream{name: "mock-" + strconv.Itoa(i+1), failRate: failRate}
+		m.srv = httptest.NewServer(m)
+		mocks[i] = m
+
+		addr := m.srv.Listener.Addr().(*net.TCPAddr)
+		proxies[i] = Proxy{
+			Scheme: schemeHTTP,
+			Host:   addr.IP.String(),
+			Port:   addr.Port,
+			Tags:   []string{"mock"},
+			Weight: defaultWeight,
+		}
+	}
+	return mocks, proxies
+}
+
+// closeMockUpstreams shuts the mock upstreams down.
+func closeMockUpstreams(mocks []*mockUpstream) {
+	for _, m := range mocks {
+		m.srv.Close()
+	}
+}
+
+func (m *mockUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handled.Add(1)
+	w.Header().Set(mockUpstreamHeader, m.name)
+	if m.broken.Load() || rand.Float64() < m.failRate {
+		http.Error(w, m.name+" failed on purpose", http.StatusBadGateway)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		m.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "mock upstream only accepts proxy requests", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s: %s %s\n", m.name, r.Method, r.URL)
+}
+
+func (m *mockUpstream) tunnel(w http.ResponseWriter, r *http.Request) {
+	target, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	client, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, target)
+		done <- struct{}{}
+	}()
+	<-done
+}
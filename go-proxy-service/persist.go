@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// proxyState is the persisted form of one pool entry, keyed by the proxy's
+// String() so it survives credential or config changes.
+type proxyState struct {
+	Proxy            string        `json:"proxy"`
+	Healthy          bool          `json:"healthy"`
+	LastHandout      time.Time     `json:"last_handout"`
+	Successes        int64         `json:"successes"`
+	Failures         int64         `json:"failures"`
+	LatencyTotal     time.Duration `json:"latency_total"`
+	LatencySamples   int64         `json:"latency_samples"`
+	QuarantinedUntil time.Time     `json:"quarantined_until"`
+	BannedUntil      time.Time     `json:"banned_until"`
+	CheckLatency     time.Duration `json:"check_latency"`
+	HTTPSHealthy     *bool         `json:"https_healthy,omitempty"`
+}
+
+// loadState reads a snapshot written by saveState. A missing file is not an
+// error and yields no state.
+func loadState(path string) ([]proxyState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var states []proxyState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// saveState writes the pool's state to path via a temporary file so a crash
+// mid-write never leaves a truncated snapshot behind.
+func saveState(path string, pool *ProxyPool) error {
+	data, err := json.Marshal(pool.State())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshotState saves the pool to path every interval, and once more when
+// ctx is cancelled so the latest state is kept across a clean restart.
+func snapshotState(ctx context.Context, path string, interval time.Duration, pool *ProxyPool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := saveState(path, pool); err != nil {
+				slog.Error("final state snapshot failed", "path", path, "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := saveState(path, pool); err != nil {
+				slog.Error("state snapshot failed", "path", path, "error", err)
+			}
+		}
+	}
+}
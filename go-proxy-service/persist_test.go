@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreMergesSavedState(t *testing.T) {
+	proxies := testProxies(3)
+	old := NewProxyPool(proxies, PoolOptions{})
+	old.MarkHealthy(proxies[1].String(), false)
+	old.Report(proxies[1].String(), true, 50*time.Millisecond)
+	old.Report(proxies[2].String(), false, 0)
+	old.Ban(proxies[2].String(), time.Hour)
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := saveState(path, old); err != nil {
+		t.Fatal(err)
+	}
+	states, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// proxies[0] was dropped from the config and a new proxy was added.
+	added := Proxy{Scheme: schemeHTTP, Host: "10.0.0.2", Port: 3000, Weight: defaultWeight}
+	pool := NewProxyPool([]Proxy{proxies[1], proxies[2], added}, PoolOptions{})
+	if n := pool.Restore(states); n != 2 {
+		t.Fatalf("restored %d proxies, want 2", n)
+	}
+
+	stats := pool.Stats()
+	if s := stats[0]; s.Healthy || s.Successes != 1 || s.AvgLatencyMs != 50 {
+		t.Errorf("restored %s = %+v, want unhealthy with 1 success at 50ms", proxies[1], s)
+	}
+	if s := stats[1]; s.Failures != 1 || s.BannedUntil == nil || time.Until(*s.BannedUntil) < 50*time.Minute {
+		t.Errorf("restored %s = %+v, want 1 failure and still banned", proxies[2], s)
+	}
+	if s := stats[2]; !s.Healthy || s.Successes != 0 || s.Failures != 0 || s.BannedUntil != nil {
+		t.Errorf("new proxy %s = %+v, want fresh state", added, s)
+	}
+}
+
+func TestLoadStateMissingFile(t *testing.T) {
+	states, err := loadState(filepath.Join(t.TempDir(), "absent.json"))
+	if err != nil || states != nil {
+		t.Errorf("loadState(missing) = %v, %v, want no state and no error", states, err)
+	}
+}
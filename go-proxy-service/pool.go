@@ -0,0 +1,625 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errNoHealthyProxies  = errors.New("no healthy proxies available")
+	errNoMatchingProxies = errors.New("no proxies match the request")
+	errUnknownProxy      = errors.New("proxy is not in the pool")
+	errDuplicateProxy    = errors.New("proxy is already in the pool")
+	errAllSaturated      = errors.New("all matching proxies are at their concurrency limit")
+)
+
+// PoolOptions controls how client reports affect selection.
+type PoolOptions struct {
+	// MaxFailureRatio quarantines a proxy once failures/(successes+failures)
+	// exceeds it. Zero disables quarantine.
+	MaxFailureRatio float64
+	// MinReports is the number of reports needed before the ratio is trusted.
+	MinReports int
+	// QuarantineFor is how long a quarantined proxy is kept out of rotation.
+	QuarantineFor time.Duration
+	// Cooldown keeps a just-handed-out proxy out of selection for this long
+	// while others are free. Zero disables it.
+	Cooldown time.Duration
+	// BreakerThreshold is the number of consecutive failures that opens a
+	// proxy's circuit breaker. Zero disables the breaker.
+	BreakerThreshold int
+	// BreakerCooldown is how long an open breaker waits before allowing a
+	// trial request.
+	BreakerCooldown time.Duration
+	// WarmUp ramps the selection weight of a proxy added after startup
+	// linearly from zero to full over this long. Zero disables it.
+	WarmUp time.Duration
+	// Events, if set, is told about health changes, bans and handouts.
+	Events *eventHub
+}
+
+type poolEntry struct {
+	proxy            Proxy
+	healthy          bool
+	lastHandout      time.Time
+	successes        int64
+	failures         int64
+	latencyTotal     time.Duration
+	latencySamples   int64
+	quarantinedUntil time.Time
+	bannedUntil      time.Time
+	// checkLatency is an exponential moving average of health-check
+	// round trips; zero until the first successful check.
+	checkLatency time.Duration
+	// inFlight counts handouts not yet released.
+	inFlight int
+	// httpsHealthy is the result of the last HTTPS check; httpsChecked is
+	// false until one has run.
+	httpsChecked bool
+	httpsHealthy bool
+	breaker      breaker
+	// addedAt is when the proxy joined the pool; zero for proxies present
+	// at startup, which need no warm-up.
+	addedAt time.Time
+}
+
+func (e *poolEntry) available(now time.Time) bool {
+	return e.healthy && !now.Before(e.quarantinedUntil) && !now.Before(e.bannedUntil) && e.breaker.allows(now)
+}
+
+// warmupFactor scales the entry's selection weight while it warms up: 0
+// when just added, rising linearly to 1 once warmUp has passed.
+func (e *poolEntry) warmupFactor(now time.Time, warmUp time.Duration) float64 {
+	if warmUp <= 0 || e.addedAt.IsZero() {
+		return 1
+	}
+	return min(1, float64(now.Sub(e.addedAt))/float64(warmUp))
+}
+
+func (e *poolEntry) saturated() bool {
+	return e.proxy.MaxConcurrent > 0 && e.inFlight >= e.proxy.MaxConcurrent
+}
+
+// ProxyStats is a point-in-time view of one proxy's usage.
+type ProxyStats struct {
+	Proxy            string     `json:"proxy"`
+	Healthy          bool       `json:"healthy"`
+	Breaker          string     `json:"breaker"`
+	HTTPSHealthy     *bool      `json:"https_healthy,omitempty"`
+	Successes        int64      `json:"successes"`
+	Failures         int64      `json:"failures"`
+	AvgLatencyMs     float64    `json:"avg_latency_ms"`
+	LastUsed         *time.Time `json:"last_used,omitempty"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	BannedUntil      *time.Time `json:"banned_until,omitempty"`
+	CheckLatencyMs   float64    `json:"check_latency_ms"`
+	Weight           int        `json:"weight"`
+	EffectiveWeight  float64    `json:"effective_weight"`
+	WarmupFactor     float64    `json:"warmup_factor"`
+	InFlight         int        `json:"in_flight"`
+	MaxConcurrent    int        `json:"max_concurrent,omitempty"`
+}
+
+// ProxyPool holds the current set of proxies and their health, and is safe
+// for concurrent use. All entry state is guarded by mu; nothing outside the
+// pool's methods may touch a poolEntry.
+type ProxyPool struct {
+	mu      sync.RWMutex
+	opts    PoolOptions
+	entries []*poolEntry
+}
+
+func NewProxyPool(proxies []Proxy, opts PoolOptions) *ProxyPool {
+	p := &ProxyPool{opts: opts}
+	p.Replace(proxies)
+	for _, e := range p.entries {
+		e.addedAt = time.Time{}
+	}
+	return p
+}
+
+// Replace swaps in a new proxy list, e.g. after a config reload. Proxies
+// that were already in the pool keep their health and stats; new ones start
+// out healthy until the next check says otherwise.
+func (p *ProxyPool) Replace(proxies []Proxy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := make(map[string]*poolEntry, len(p.entries))
+	for _, e := range p.entries {
+		old[e.proxy.String()] = e
+	}
+
+	entries := make([]*poolEntry, 0, len(proxies))
+	for _, proxy := range proxies {
+		e, ok := old[proxy.String()]
+		if !ok {
+			e = &poolEntry{healthy: true, addedAt: time.Now()}
+		}
+		e.proxy = proxy
+		entries = append(entries, e)
+	}
+	p.entries = entries
+}
+
+// Add puts a new proxy into the pool. It starts out healthy until the next
+// check says otherwise.
+func (p *ProxyPool) Add(proxy Proxy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.find(proxy.String()) != nil {
+		return errDuplicateProxy
+	}
+	p.entries = append(p.entries, &poolEntry{proxy: proxy, healthy: true, addedAt: time.Now()})
+	return nil
+}
+
+// Remove takes the proxy identified by id out of the pool, along with its
+// health and stats.
+func (p *ProxyPool) Remove(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, e := range p.entries {
+		if e.proxy.String() == id {
+			p.entries = append(p.entries[:i:i], p.entries[i+1:]...)
+			return nil
+		}
+	}
+	return errUnknownProxy
+}
+
+// All returns a copy of every proxy in the pool, healthy or not.
+func (p *ProxyPool) All() []Proxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := make([]Proxy, len(p.entries))
+	for i, e := range p.entries {
+		out[i] = e.proxy
+	}
+	return out
+}
+
+// Get returns the proxy identified by id.
+func (p *ProxyPool) Get(id string) (Proxy, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if e := p.find(id); e != nil {
+		return e.proxy, true
+	}
+	return Proxy{}, false
+}
+
+// HealthCounts returns how many proxies are currently healthy and unhealthy.
+func (p *ProxyPool) HealthCounts() (healthy, unhealthy int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, e := range p.entries {
+		if e.healthy {
+			healthy++
+		} else {
+			unhealthy++
+		}
+	}
+	return healthy, unhealthy
+}
+
+// Available returns how many proxies passing filters can currently be
+// handed out.
+func (p *ProxyPool) Available(filters ...Filter) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	n := 0
+	for _, e := range p.entries {
+		if e.available(now) && accepts(filters, e.proxy) {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns the entry whose String() is id. Callers must hold p.mu.
+func (p *ProxyPool) find(id string) *poolEntry {
+	for _, e := range p.entries {
+		if e.proxy.String() == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// MarkHealthy records the result of a health check for the proxy identified
+// by id. Unknown ids are ignored.
+func (p *ProxyPool) MarkHealthy(id string, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.find(id)
+	if e == nil || e.healthy == healthy {
+		return
+	}
+	e.healthy = healthy
+	ev := poolEvent{Type: eventUnhealthy, Proxy: id, Time: time.Now()}
+	if healthy {
+		ev.Type = eventHealthy
+	}
+	p.opts.Events.Publish(ev)
+}
+
+// MarkHTTPSHealthy records the result of an HTTPS health check for the proxy
+// identified by id. Unknown ids are ignored.
+func (p *ProxyPool) MarkHTTPSHealthy(id string, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e := p.find(id); e != nil {
+		e.httpsChecked = true
+		e.httpsHealthy = healthy
+	}
+}
+
+// httpsFilter returns a Filter rejecting proxies whose last HTTPS check
+// failed. Proxies not yet checked pass, like new proxies do for HTTP.
+func (p *ProxyPool) httpsFilter() Filter {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	failed := make(map[string]bool)
+	for _, e := range p.entries {
+		if e.httpsChecked && !e.httpsHealthy {
+			failed[e.proxy.String()] = true
+		}
+	}
+	return func(proxy Proxy) bool { return !failed[proxy.String()] }
+}
+
+// latencyEMAWeight is how much a new health-check sample moves the average.
+const latencyEMAWeight = 0.3
+
+// RecordCheckLatency folds a successful health check's round-trip time into
+// the proxy's moving average latency.
+func (p *ProxyPool) RecordCheckLatency(id string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.find(id)
+	if e == nil {
+		return
+	}
+	if e.checkLatency == 0 {
+		e.checkLatency = d
+		return
+	}
+	e.checkLatency = time.Duration(latencyEMAWeight*float64(d) + (1-latencyEMAWeight)*float64(e.checkLatency))
+}
+
+// Report records the outcome of a client using a proxy. A zero latency means
+// the client did not measure it. Proxies whose failure ratio climbs past the
+// configured limit are quarantined, and reports drive each proxy's circuit
+// breaker.
+func (p *ProxyPool) Report(id string, success bool, latency time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.find(id)
+	if e == nil {
+		return errUnknownProxy
+	}
+
+	if success {
+		e.successes++
+	} else {
+		e.failures++
+	}
+	if latency > 0 {
+		e.latencyTotal += latency
+		e.latencySamples++
+	}
+
+	now := time.Now()
+	e.breaker.record(success, now, p.opts.BreakerThreshold, p.opts.BreakerCooldown)
+
+	total := e.successes + e.failures
+	if !success && p.opts.MaxFailureRatio > 0 && total >= int64(p.opts.MinReports) {
+		if float64(e.failures)/float64(total) > p.opts.MaxFailureRatio {
+			e.quarantinedUntil = now.Add(p.opts.QuarantineFor)
+		}
+	}
+	return nil
+}
+
+// Release marks one handout of the proxy identified by id as finished,
+// freeing a concurrency slot.
+func (p *ProxyPool) Release(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.find(id)
+	if e == nil {
+		return errUnknownProxy
+	}
+	if e.inFlight > 0 {
+		e.inFlight--
+	}
+	return nil
+}
+
+// Ban keeps the proxy identified by id out of rotation for d. Once the ban
+// lapses the proxy is eligible again, subject to its health.
+func (p *ProxyPool) Ban(id string, d time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.find(id)
+	if e == nil {
+		return errUnknownProxy
+	}
+	now := time.Now()
+	e.bannedUntil = now.Add(d)
+	until := e.bannedUntil
+	p.opts.Events.Publish(poolEvent{Type: eventBanned, Proxy: id, Time: now, Until: &until})
+	return nil
+}
+
+// Stats returns a snapshot of every proxy's usage counters.
+func (p *ProxyPool) Stats() []ProxyStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	out := make([]ProxyStats, len(p.entries))
+	for i, e := range p.entries {
+		out[i] = e.stats(now, p.opts.WarmUp)
+	}
+	return out
+}
+
+// PoolProxy is one pool member's configuration alongside its stats, as
+// listed by the /proxies admin endpoint.
+type PoolProxy struct {
+	ProxyStats
+	Config Proxy `json:"config"`
+}
+
+// Inventory returns every proxy's configuration and stats, taken under a
+// single lock so the two always agree.
+func (p *ProxyPool) Inventory() []PoolProxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	now := time.Now()
+	out := make([]PoolProxy, len(p.entries))
+	for i, e := range p.entries {
+		out[i] = PoolProxy{ProxyStats: e.stats(now, p.opts.WarmUp), Config: e.proxy}
+	}
+	return out
+}
+
+func (e *poolEntry) stats(now time.Time, warmUp time.Duration) ProxyStats {
+	s := ProxyStats{
+		Proxy:     e.proxy.String(),
+		Healthy:   e.healthy,
+		Breaker:   e.breaker.state(now),
+		Successes: e.successes,
+		Failures:  e.failures,
+
+		CheckLatencyMs: float64(e.checkLatency) / float64(time.Millisecond),
+		Weight:         e.proxy.Weight,
+		WarmupFactor:   e.warmupFactor(now, warmUp),
+		InFlight:       e.inFlight,
+		MaxConcurrent:  e.proxy.MaxConcurrent,
+	}
+	if e.available(now) && !e.saturated() {
+		s.EffectiveWeight = float64(e.proxy.Weight) * s.WarmupFactor
+	}
+	if e.httpsChecked {
+		ok := e.httpsHealthy
+		s.HTTPSHealthy = &ok
+	}
+	if e.latencySamples > 0 {
+		s.AvgLatencyMs = float64(e.latencyTotal.Milliseconds()) / float64(e.latencySamples)
+	}
+	if !e.lastHandout.IsZero() {
+		t := e.lastHandout
+		s.LastUsed = &t
+	}
+	if now.Before(e.quarantinedUntil) {
+		t := e.quarantinedUntil
+		s.QuarantinedUntil = &t
+	}
+	if now.Before(e.bannedUntil) {
+		t := e.bannedUntil
+		s.BannedUntil = &t
+	}
+	return s
+}
+
+// State returns the persistable state of every proxy in the pool.
+func (p *ProxyPool) State() []proxyState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := make([]proxyState, len(p.entries))
+	for i, e := range p.entries {
+		out[i] = proxyState{
+			Proxy:            e.proxy.String(),
+			Healthy:          e.healthy,
+			LastHandout:      e.lastHandout,
+			Successes:        e.successes,
+			Failures:         e.failures,
+			LatencyTotal:     e.latencyTotal,
+			LatencySamples:   e.latencySamples,
+			QuarantinedUntil: e.quarantinedUntil,
+			BannedUntil:      e.bannedUntil,
+			CheckLatency:     e.checkLatency,
+		}
+		if e.httpsChecked {
+			ok := e.httpsHealthy
+			out[i].HTTPSHealthy = &ok
+		}
+	}
+	return out
+}
+
+// Restore applies previously saved state to the proxies currently in the
+// pool, matched by proxy. Saved proxies no longer in the pool are ignored,
+// and pool proxies missing from the snapshot keep their fresh state. It
+// returns how many proxies were restored.
+func (p *ProxyPool) Restore(states []proxyState) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	restored := 0
+	for _, st := range states {
+		e := p.find(st.Proxy)
+		if e == nil {
+			continue
+		}
+		e.healthy = st.Healthy
+		e.lastHandout = st.LastHandout
+		e.successes = st.Successes
+		e.failures = st.Failures
+		e.latencyTotal = st.LatencyTotal
+		e.latencySamples = st.LatencySamples
+		e.quarantinedUntil = st.QuarantinedUntil
+		e.bannedUntil = st.BannedUntil
+		e.checkLatency = st.CheckLatency
+		if st.HTTPSHealthy != nil {
+			e.httpsChecked, e.httpsHealthy = true, *st.HTTPSHealthy
+		}
+		restored++
+	}
+	return restored
+}
+
+// reuse hands out the proxy identified by id again to a sticky session,
+// provided it is still in the pool, available and accepted by filters. With
+// takeSlot the handout takes a concurrency slot like any other and is
+// refused if none is free; without it the session goes on using the slot it
+// already holds.
+func (p *ProxyPool) reuse(id string, filters []Filter, takeSlot bool) (Proxy, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	e := p.find(id)
+	if e == nil || !e.available(now) || e.proxy.Weight == 0 || !accepts(filters, e.proxy) {
+		return Proxy{}, false
+	}
+	if takeSlot {
+		if e.saturated() {
+			return Proxy{}, false
+		}
+		e.inFlight++
+	}
+	p.handout(e, now)
+	return e.proxy, true
+}
+
+// handout records that e was given out at now. Taking a concurrency slot is
+// up to the caller.
+func (p *ProxyPool) handout(e *poolEntry, now time.Time) {
+	e.lastHandout = now
+	e.breaker.handedOut(now, p.opts.BreakerCooldown)
+	proxyHandouts.WithLabelValues(e.proxy.String()).Inc()
+	p.opts.Events.Publish(poolEvent{Type: eventHandout, Proxy: e.proxy.String(), Time: now})
+}
+
+// next hands out one available, unsaturated proxy with a non-zero weight,
+// accepted by filters and chosen by pick, recording the handout time and
+// taking a concurrency slot that the caller must eventually Release. The
+// pool is write-locked for the duration, so pick sees a consistent view and
+// concurrent callers are serialised.
+//
+// It returns errNoMatchingProxies if no proxy passes the filters at all,
+// errNoHealthyProxies if some do but none of those are currently available,
+// and errAllSaturated if the available ones are all at their limit.
+//
+// Proxies still within the pool's cooldown are only picked when every
+// candidate is, in which case the least recently used one is returned.
+func (p *ProxyPool) next(filters []Filter, pick func(candidates []*poolEntry) *poolEntry) (Proxy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	matched, available := false, false
+	candidates := make([]*poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		if !accepts(filters, e.proxy) {
+			continue
+		}
+		matched = true
+		if !e.available(now) || e.proxy.Weight == 0 {
+			continue
+		}
+		available = true
+		if !e.saturated() {
+			candidates = append(candidates, e)
+		}
+	}
+	switch {
+	case !matched && len(p.entries) > 0:
+		return Proxy{}, errNoMatchingProxies
+	case !available:
+		return Proxy{}, errNoHealthyProxies
+	case len(candidates) == 0:
+		return Proxy{}, errAllSaturated
+	}
+
+	var e *poolEntry
+	if rested := p.rested(candidates, now); len(rested) > 0 {
+		e = pick(rested)
+	} else {
+		e = leastRecentlyUsed(candidates)
+	}
+	e.inFlight++
+	p.handout(e, now)
+	return e.proxy, nil
+}
+
+// selectionWeight is e's configured weight scaled by its warm-up. Callers
+// must hold p.mu.
+func (p *ProxyPool) selectionWeight(e *poolEntry, now time.Time) float64 {
+	return float64(e.proxy.Weight) * e.warmupFactor(now, p.opts.WarmUp)
+}
+
+// rested returns the candidates outside their cooldown. With no cooldown
+// configured that is all of them.
+func (p *ProxyPool) rested(candidates []*poolEntry, now time.Time) []*poolEntry {
+	if p.opts.Cooldown <= 0 {
+		return candidates
+	}
+	var out []*poolEntry
+	for _, e := range candidates {
+		if now.Sub(e.lastHandout) >= p.opts.Cooldown {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func leastRecentlyUsed(candidates []*poolEntry) *poolEntry {
+	oldest := candidates[0]
+	for _, e := range candidates[1:] {
+		if e.lastHandout.Before(oldest.lastHandout) {
+			oldest = e
+		}
+	}
+	return oldest
+}
+
+func accepts(filters []Filter, proxy Proxy) bool {
+	for _, f := range filters {
+		if !f(proxy) {
+			return false
+		}
+	}
+	return true
+}
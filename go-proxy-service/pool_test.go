@@ -0,0 +1,280 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testProxies(n int) []Proxy {
+	proxies := make([]Proxy, n)
+	for i := range proxies {
+		proxies[i] = Proxy{Scheme: schemeHTTP, Host: "10.0.0.1", Port: 3000 + i, Weight: defaultWeight}
+	}
+	return proxies
+}
+
+// TestProxyPoolConcurrentAccess hammers every pool method from many
+// goroutines at once. It asserts little by itself; run it with -race.
+func TestProxyPoolConcurrentAccess(t *testing.T) {
+	proxies := testProxies(8)
+	pool := NewProxyPool(proxies, PoolOptions{MaxFailureRatio: 0.5, MinReports: 2, QuarantineFor: time.Millisecond})
+	selectors := []Selector{&randomSelector{pool: pool}, &lruSelector{pool: pool}}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := proxies[(g+i)%len(proxies)].String()
+				switch i % 8 {
+				case 0:
+					selectors[g%2].Next()
+				case 1:
+					pool.MarkHealthy(id, i%3 != 0)
+				case 2:
+					pool.Report(id, i%2 == 0, time.Millisecond)
+				case 3:
+					pool.Ban(id, time.Microsecond)
+				case 4:
+					pool.Stats()
+				case 5:
+					pool.Get(id)
+				case 6:
+					pool.State()
+				case 7:
+					if g == 0 {
+						pool.Replace(proxies)
+					}
+					pool.HealthCounts()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if got := len(pool.All()); got != len(proxies) {
+		t.Fatalf("pool has %d proxies after concurrent use, want %d", got, len(proxies))
+	}
+}
+
+func TestProxyPoolNextSkipsUnavailable(t *testing.T) {
+	proxies := testProxies(3)
+	pool := NewProxyPool(proxies, PoolOptions{})
+	pool.MarkHealthy(proxies[0].String(), false)
+	pool.Ban(proxies[1].String(), time.Hour)
+
+	sel := &randomSelector{pool: pool}
+	for i := 0; i < 20; i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != proxies[2].String() {
+			t.Fatalf("Next() = %s, want %s", p, proxies[2])
+		}
+	}
+
+	pool.MarkHealthy(proxies[2].String(), false)
+	if _, err := sel.Next(); err != errNoHealthyProxies {
+		t.Fatalf("Next() error = %v, want %v", err, errNoHealthyProxies)
+	}
+}
+
+func TestLRUSelectorRotates(t *testing.T) {
+	proxies := testProxies(4)
+	sel := &lruSelector{pool: NewProxyPool(proxies, PoolOptions{})}
+
+	seen := make(map[string]int)
+	for i := 0; i < len(proxies)*3; i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[p.String()]++
+		// Handout times need to differ for LRU ordering to be strict.
+		time.Sleep(time.Millisecond)
+	}
+	for _, p := range proxies {
+		if seen[p.String()] != 3 {
+			t.Errorf("%s handed out %d times, want 3 (%v)", p, seen[p.String()], seen)
+		}
+	}
+}
+
+func TestFastestSelectorPrefersLowLatency(t *testing.T) {
+	proxies := testProxies(2)
+	pool := NewProxyPool(proxies, PoolOptions{})
+	pool.RecordCheckLatency(proxies[0].String(), 10*time.Millisecond)
+	pool.RecordCheckLatency(proxies[1].String(), 90*time.Millisecond)
+	sel := &fastestSelector{pool: pool}
+
+	fast := 0
+	const rounds = 2000
+	for i := 0; i < rounds; i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() == proxies[0].String() {
+			fast++
+		}
+	}
+	// Expected share is 0.9; allow generous slack for randomness while
+	// still requiring that the slow proxy is picked sometimes.
+	if fast < rounds*8/10 || fast == rounds {
+		t.Fatalf("fast proxy picked %d/%d times, want about 90%%", fast, rounds)
+	}
+}
+
+func TestRandomSelectorHonoursWeights(t *testing.T) {
+	proxies := testProxies(3)
+	proxies[0].Weight = 3
+	proxies[1].Weight = 1
+	proxies[2].Weight = 0
+	sel := &randomSelector{pool: NewProxyPool(proxies, PoolOptions{})}
+
+	counts := make(map[string]int)
+	const rounds = 4000
+	for i := 0; i < rounds; i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[p.String()]++
+	}
+	if counts[proxies[2].String()] != 0 {
+		t.Errorf("weight-0 proxy picked %d times", counts[proxies[2].String()])
+	}
+	// Expected share of the weight-3 proxy is 0.75.
+	if share := float64(counts[proxies[0].String()]) / rounds; share < 0.7 || share > 0.8 {
+		t.Errorf("weight-3 proxy share = %.2f, want about 0.75", share)
+	}
+}
+
+func TestCooldownSkipsRecentlyUsed(t *testing.T) {
+	proxies := testProxies(3)
+	sel := &randomSelector{pool: NewProxyPool(proxies, PoolOptions{Cooldown: time.Hour})}
+
+	// Every proxy is handed out once before any repeats.
+	seen := make(map[string]bool)
+	for i := 0; i < len(proxies); i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[p.String()] {
+			t.Fatalf("%s handed out twice within its cooldown", p)
+		}
+		seen[p.String()] = true
+		time.Sleep(time.Millisecond)
+	}
+
+	// With all of them cooling down, the least recently used comes next.
+	order := make([]Proxy, 0, len(proxies))
+	for i := 0; i < len(proxies); i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, p)
+		time.Sleep(time.Millisecond)
+	}
+	again, err := sel.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != order[0].String() {
+		t.Fatalf("Next() = %s with every proxy cooling down, want least recently used %s", again, order[0])
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	proxies := testProxies(1)
+	id := proxies[0].String()
+	pool := NewProxyPool(proxies, PoolOptions{BreakerThreshold: 2, BreakerCooldown: 20 * time.Millisecond})
+	sel := &randomSelector{pool: pool}
+	breakerState := func() string { return pool.Stats()[0].Breaker }
+
+	pool.Report(id, false, 0)
+	if got := breakerState(); got != breakerClosed {
+		t.Fatalf("after one failure breaker = %s, want %s", got, breakerClosed)
+	}
+	pool.Report(id, false, 0)
+	if got := breakerState(); got != breakerOpen {
+		t.Fatalf("after two failures breaker = %s, want %s", got, breakerOpen)
+	}
+	if _, err := sel.Next(); err != errNoHealthyProxies {
+		t.Fatalf("Next() with open breaker error = %v, want %v", err, errNoHealthyProxies)
+	}
+
+	// Half-open lets exactly one trial through.
+	time.Sleep(25 * time.Millisecond)
+	if got := breakerState(); got != breakerHalfOpen {
+		t.Fatalf("after cooldown breaker = %s, want %s", got, breakerHalfOpen)
+	}
+	if _, err := sel.Next(); err != nil {
+		t.Fatalf("trial Next() error = %v", err)
+	}
+	if _, err := sel.Next(); err != errNoHealthyProxies {
+		t.Fatalf("second Next() during trial error = %v, want %v", err, errNoHealthyProxies)
+	}
+
+	// A failed trial re-opens; a successful one closes.
+	pool.Report(id, false, 0)
+	if got := breakerState(); got != breakerOpen {
+		t.Fatalf("after failed trial breaker = %s, want %s", got, breakerOpen)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if _, err := sel.Next(); err != nil {
+		t.Fatalf("trial Next() error = %v", err)
+	}
+	pool.Report(id, true, 0)
+	if got := breakerState(); got != breakerClosed {
+		t.Fatalf("after successful trial breaker = %s, want %s", got, breakerClosed)
+	}
+}
+
+func TestWarmUpRampsNewProxies(t *testing.T) {
+	proxies := testProxies(2)
+	proxies[1].Weight = 4
+	pool := NewProxyPool(proxies[:1], PoolOptions{WarmUp: time.Hour})
+	if err := pool.Add(proxies[1]); err != nil {
+		t.Fatal(err)
+	}
+	factor := func(i int) float64 { return pool.Stats()[i].WarmupFactor }
+
+	if got := factor(0); got != 1 {
+		t.Errorf("startup proxy warmup factor = %v, want 1", got)
+	}
+	if got := factor(1); got > 0.01 {
+		t.Errorf("just added proxy warmup factor = %v, want about 0", got)
+	}
+	sel := &randomSelector{pool: pool}
+	for i := 0; i < 50; i++ {
+		p, err := sel.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.Release(p.String())
+		if p.String() == proxies[1].String() {
+			t.Fatal("proxy picked while barely warmed up")
+		}
+	}
+
+	pool.entries[1].addedAt = time.Now().Add(-30 * time.Minute)
+	if got := factor(1); got < 0.49 || got > 0.51 {
+		t.Errorf("half warmed up factor = %v, want 0.5", got)
+	}
+	if got := pool.Stats()[1].EffectiveWeight; got < 1.96 || got > 2.04 {
+		t.Errorf("half warmed up effective weight = %v, want 2 of weight 4", got)
+	}
+	pool.entries[1].addedAt = time.Now().Add(-2 * time.Hour)
+	if got := factor(1); got != 1 {
+		t.Errorf("warmed up factor = %v, want 1", got)
+	}
+	if got := pool.Stats()[1].EffectiveWeight; got != 4 {
+		t.Errorf("warmed up effective weight = %v, want 4", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// providerFields are the proxy attributes that can be read from a provider
+// response. Each may be renamed with -provider-fields.
+var providerFields = []string{"url", "scheme", "host", "port", "username", "password", "country", "tags", "weight"}
+
+// providerSource periodically downloads the proxy list from a provider's
+// HTTP API and swaps it into the pool. A failed fetch leaves the pool as is.
+type providerSource struct {
+	url      string
+	listPath []string          // keys leading to the proxy array
+	fields   map[string]string // proxy attribute -> provider field name
+	interval time.Duration
+	client   *http.Client
+}
+
+// newProviderSource builds a source for url. listPath is a dot-separated
+// path to the array of proxies in the response ("" for a top-level array);
+// fieldMap is a comma-separated list of attr=field overrides such as
+// "url=proxy,country=geo".
+func newProviderSource(url, listPath, fieldMap string, interval, timeout time.Duration) (*providerSource, error) {
+	fields := make(map[string]string, len(providerFields))
+	for _, f := range providerFields {
+		fields[f] = f
+	}
+	for _, pair := range strings.Split(fieldMap, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		attr, name, ok := strings.Cut(pair, "=")
+		if _, known := fields[attr]; !ok || !known || name == "" {
+			return nil, fmt.Errorf("invalid provider field mapping %q (want attr=field, attr one of %s)", pair, strings.Join(providerFields, ", "))
+		}
+		fields[attr] = name
+	}
+
+	var path []string
+	if listPath != "" {
+		path = strings.Split(listPath, ".")
+	}
+	return &providerSource{
+		url:      url,
+		listPath: path,
+		fields:   fields,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Run refreshes pool once per interval until ctx is cancelled. The pool is
+// expected to have been built from an initial fetch, so Run waits a full
+// interval before its first refresh.
+func (p *providerSource) Run(ctx context.Context, pool *ProxyPool) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		proxies, err := p.fetch(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("provider refresh failed, keeping last known proxies", "url", p.url, "error", err)
+			}
+			continue
+		}
+		pool.Replace(proxies)
+	}
+}
+
+func (p *providerSource) fetch(ctx context.Context) ([]Proxy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var body any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	for _, key := range p.listPath {
+		obj, ok := body.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("response has no object at %q", key)
+		}
+		body = obj[key]
+	}
+	items, ok := body.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a JSON array of proxies at %q", strings.Join(p.listPath, "."))
+	}
+
+	entries := make([]proxyEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, p.entry(item))
+	}
+	return buildProxies(p.url, entries)
+}
+
+// entry maps one provider item onto a config entry. A bare string is taken
+// as the proxy URL. Missing or mistyped fields are left empty and caught by
+// validation.
+func (p *providerSource) entry(item any) proxyEntry {
+	if s, ok := item.(string); ok {
+		return proxyEntry{URL: s}
+	}
+	obj, _ := item.(map[string]any)
+	str := func(attr string) string {
+		switch v := obj[p.fields[attr]].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+	port, _ := strconv.Atoi(str("port"))
+	var weight *int
+	if w, err := strconv.Atoi(str("weight")); err == nil {
+		weight = &w
+	}
+	// Tags may be an array of strings or one comma-separated string.
+	var tags []string
+	switch v := obj[p.fields["tags"]].(type) {
+	case string:
+		tags = strings.Split(v, ",")
+	case []any:
+		for _, t := range v {
+			if t, ok := t.(string); ok {
+				tags = append(tags, t)
+			}
+		}
+	}
+	return proxyEntry{
+		URL:      str("url"),
+		Scheme:   str("scheme"),
+		Host:     str("host"),
+		Port:     port,
+		Username: str("username"),
+		Password: str("password"),
+		Country:  str("country"),
+		Tags:     tags,
+		Weight:   weight,
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startProvider serves body as the provider response; swap body to change
+// what later fetches see.
+func startProvider(t *testing.T, body *atomic.Value) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := body.Load().(string)
+		if b == "" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, b)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestProviderFieldMappingAndListPath(t *testing.T) {
+	var body atomic.Value
+	body.Store(`{"data": {"proxies": [
+		{"addr": "10.0.0.1", "p": 3128, "geo": "de", "labels": ["dc", "fast"], "weight": 3},
+		{"addr": "10.0.0.2", "p": "8080", "geo": "US", "labels": "residential,slow"},
+		"http://10.0.0.3:9000"
+	]}}`)
+	source, err := newProviderSource(startProvider(t, &body), "data.proxies", "host=addr, port=p,country=geo,tags=labels", time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := source.fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(proxies) != 3 {
+		t.Fatalf("fetched %d proxies, want 3: %v", len(proxies), proxies)
+	}
+	if p := proxies[0]; p.String() != "http://10.0.0.1:3128" || p.Country != "DE" || p.Weight != 3 || len(p.Tags) != 2 || p.Tags[1] != "fast" {
+		t.Errorf("proxies[0] = %+v", p)
+	}
+	if p := proxies[1]; p.String() != "http://10.0.0.2:8080" || p.Country != "US" || len(p.Tags) != 2 || p.Tags[0] != "residential" {
+		t.Errorf("proxies[1] = %+v", p)
+	}
+	if p := proxies[2]; p.String() != "http://10.0.0.3:9000" {
+		t.Errorf("proxies[2] = %+v", p)
+	}
+}
+
+func TestProviderListPathMismatch(t *testing.T) {
+	var body atomic.Value
+	body.Store(`{"data": ["http://10.0.0.1:3128"]}`)
+	url := startProvider(t, &body)
+	for _, path := range []string{"", "items", "data.proxies"} {
+		source, err := newProviderSource(url, path, "", time.Minute, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.fetch(context.Background()); err == nil {
+			t.Errorf("list path %q: fetch succeeded on a response without that array", path)
+		}
+	}
+}
+
+func TestProviderInvalidFieldMapping(t *testing.T) {
+	for _, m := range []string{"url", "ip=addr", "host="} {
+		if _, err := newProviderSource("http://provider.test/", "", m, time.Minute, time.Second); err == nil {
+			t.Errorf("field map %q was accepted", m)
+		}
+	}
+}
+
+func TestProviderRefreshKeepsLastGoodList(t *testing.T) {
+	var body atomic.Value
+	body.Store(`["http://10.0.0.1:3128"]`)
+	source, err := newProviderSource(startProvider(t, &body), "", "", 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := source.fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewProxyPool(initial, PoolOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx, pool)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForPool := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			all := pool.All()
+			if len(all) == 1 && all[0].String() == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("pool = %v, want only %s", all, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	body.Store(`["http://10.0.0.2:3128"]`)
+	waitForPool("http://10.0.0.2:3128")
+
+	for _, bad := range []string{"", `[]`, `["ftp://10.0.0.3:21"]`, `{"not": "a list"}`} {
+		body.Store(bad)
+		time.Sleep(50 * time.Millisecond) // several refresh intervals
+		waitForPool("http://10.0.0.2:3128")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ipRateLimiter keeps a token bucket per client IP. At most maxClients
+// buckets are kept; the least recently seen client is evicted first, so a
+// flood of unique addresses cannot grow memory without bound.
+type ipRateLimiter struct {
+	limit      rate.Limit
+	burst      int
+	maxClients int
+	trustXFF   bool
+
+	mu      sync.Mutex
+	order   *list.List // front = most recently seen
+	clients map[string]*list.Element
+}
+
+type clientBucket struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+func newIPRateLimiter(perSecond float64, burst, maxClients int, trustXFF bool) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:      rate.Limit(perSecond),
+		burst:      burst,
+		maxClients: maxClients,
+		trustXFF:   trustXFF,
+		order:      list.New(),
+		clients:    make(map[string]*list.Element),
+	}
+}
+
+func (l *ipRateLimiter) limiter(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.clients[ip]; ok {
+		l.order.MoveToFront(el)
+		return el.Value.(*clientBucket).limiter
+	}
+
+	if l.order.Len() >= l.maxClients {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).ip)
+	}
+	b := &clientBucket{ip: ip, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.clients[ip] = l.order.PushFront(b)
+	return b.limiter
+}
+
+// Middleware rejects requests over the client's limit with 429 and a
+// Retry-After header.
+func (l *ipRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := l.limiter(l.clientIP(r)).Reserve()
+		if delay := res.Delay(); !res.OK() || delay > 0 {
+			res.Cancel()
+			retryAfter := 1
+			if res.OK() {
+				retryAfter = int(math.Ceil(delay.Seconds()))
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only consulted
+// when the service is configured to trust it, since clients can set it to
+// anything.
+func (l *ipRateLimiter) clientIP(r *http.Request) string {
+	if l.trustXFF {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
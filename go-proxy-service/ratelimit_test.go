@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rateLimited sends one request from remoteAddr, with X-Forwarded-For set
+// to xff if non-empty, and reports whether it got 429.
+func rateLimited(t *testing.T, h http.Handler, remoteAddr, xff string) bool {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.RemoteAddr = remoteAddr
+	if xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code == http.StatusTooManyRequests
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRateLimitAfterBurst(t *testing.T) {
+	h := newIPRateLimiter(0.001, 3, 10, false).Middleware(okHandler)
+	for i := 0; i < 3; i++ {
+		if rateLimited(t, h, "192.0.2.1:1000", "") {
+			t.Fatalf("request %d within the burst was limited", i+1)
+		}
+	}
+	if !rateLimited(t, h, "192.0.2.1:1001", "") {
+		t.Error("request after the burst was not limited")
+	}
+	if rateLimited(t, h, "192.0.2.2:1000", "") {
+		t.Error("another client was limited by the first one's bucket")
+	}
+}
+
+func TestRateLimitEvictsLeastRecentClient(t *testing.T) {
+	l := newIPRateLimiter(0.001, 1, 2, false)
+	h := l.Middleware(okHandler)
+	rateLimited(t, h, "192.0.2.1:1000", "")
+	rateLimited(t, h, "192.0.2.2:1000", "")
+	rateLimited(t, h, "192.0.2.3:1000", "")
+
+	if len(l.clients) != 2 || l.order.Len() != 2 {
+		t.Fatalf("tracking %d clients, want at most 2", len(l.clients))
+	}
+	if _, ok := l.clients["192.0.2.1"]; ok {
+		t.Error("least recently seen client was not evicted")
+	}
+	if rateLimited(t, h, "192.0.2.1:1000", "") {
+		t.Error("evicted client did not get a fresh bucket")
+	}
+	if !rateLimited(t, h, "192.0.2.3:1000", "") {
+		t.Error("tracked client's exhausted bucket was reset")
+	}
+}
+
+func TestRateLimitXForwardedFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		trustXFF bool
+		wantIP   string
+	}{
+		{"ignored by default", false, "192.0.2.1"},
+		{"honoured when trusted", true, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newIPRateLimiter(0.001, 1, 10, tt.trustXFF)
+			req := httptest.NewRequest("GET", "/stats", nil)
+			req.RemoteAddr = "192.0.2.1:1000"
+			req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+			if got := l.clientIP(req); got != tt.wantIP {
+				t.Errorf("clientIP = %s, want %s", got, tt.wantIP)
+			}
+
+			// Two different forwarded clients behind the same proxy share a
+			// bucket unless X-Forwarded-For is trusted.
+			h := l.Middleware(okHandler)
+			rateLimited(t, h, "192.0.2.1:1000", "203.0.113.7")
+			if got := rateLimited(t, h, "192.0.2.1:1000", "203.0.113.8"); got == tt.trustXFF {
+				t.Errorf("second forwarded client limited = %v, want %v", got, !tt.trustXFF)
+			}
+		})
+	}
+}
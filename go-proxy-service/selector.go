@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Filter reports whether a proxy may be selected for a particular request.
+type Filter func(Proxy) bool
+
+// Selector picks the next proxy to hand out from those accepted by every
+// filter. Implementations must be safe for concurrent use.
+type Selector interface {
+	Next(filters ...Filter) (Proxy, error)
+}
+
+// newSelector returns the rotation strategy registered under name.
+func newSelector(name string, pool *ProxyPool) (Selector, error) {
+	switch name {
+	case "random":
+		return &randomSelector{pool: pool}, nil
+	case "lru":
+		return &lruSelector{pool: pool}, nil
+	case "fastest":
+		return &fastestSelector{pool: pool}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q (want random, lru or fastest)", name)
+	}
+}
+
+// randomSelector picks among available proxies with probability
+// proportional to their weight, scaled down while they warm up.
+type randomSelector struct {
+	pool *ProxyPool
+}
+
+func (s *randomSelector) Next(filters ...Filter) (Proxy, error) {
+	return s.pool.next(filters, func(candidates []*poolEntry) *poolEntry {
+		now := time.Now()
+		weights := make([]float64, len(candidates))
+		for i, e := range candidates {
+			weights[i] = s.pool.selectionWeight(e, now)
+		}
+		return candidates[weightedIndex(weights)]
+	})
+}
+
+// weightedIndex returns a random index into weights, each chosen with
+// probability proportional to its weight. If all weights are zero, as for
+// proxies that have only just started warming up, any index may be chosen.
+func weightedIndex(weights []float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0 {
+		return rand.Intn(len(weights))
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(weights) - 1
+}
+
+// lruSelector always returns the healthy proxy that has been idle longest,
+// which behaves like round-robin while spreading load evenly. It ignores
+// weights and warm-up.
+type lruSelector struct {
+	pool *ProxyPool
+}
+
+func (s *lruSelector) Next(filters ...Filter) (Proxy, error) {
+	return s.pool.next(filters, leastRecentlyUsed)
+}
+
+// fastestSelector favours proxies with low health-check latency. Each
+// candidate is weighted by the inverse of its average latency, so faster
+// proxies are picked more often without the single fastest one taking all
+// the traffic. Proxies not yet measured get the mean weight of the rest.
+// The result is scaled by each proxy's configured weight and warm-up.
+type fastestSelector struct {
+	pool *ProxyPool
+}
+
+func (s *fastestSelector) Next(filters ...Filter) (Proxy, error) {
+	return s.pool.next(filters, func(candidates []*poolEntry) *poolEntry {
+		now := time.Now()
+		weights := make([]float64, len(candidates))
+		var known, sum float64
+		for i, e := range candidates {
+			if e.checkLatency > 0 {
+				weights[i] = 1 / e.checkLatency.Seconds()
+				sum += weights[i]
+				known++
+			}
+		}
+		fallback := 1.0
+		if known > 0 {
+			fallback = sum / known
+		}
+
+		for i, e := range candidates {
+			if weights[i] == 0 {
+				weights[i] = fallback
+			}
+			weights[i] *= s.pool.selectionWeight(e, now)
+		}
+		return candidates[weightedIndex(weights)]
+	})
+}
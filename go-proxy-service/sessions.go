@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sessionCache maps client session tokens to the proxy they were given,
+// each mapping expiring ttl after it was created. Outside of leases a
+// binding holds at most one of its proxy's concurrency slots, however often
+// the session is hit.
+type sessionCache struct {
+	pool *ProxyPool
+	ttl  time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+type session struct {
+	proxy   string
+	expires time.Time
+	// holding is set while the binding holds a concurrency slot on proxy.
+	holding bool
+}
+
+func newSessionCache(pool *ProxyPool, ttl time.Duration) *sessionCache {
+	return &sessionCache{pool: pool, ttl: ttl, sessions: make(map[string]session)}
+}
+
+// Next returns the proxy bound to token, binding one chosen by sel if the
+// session is new, expired or its proxy is no longer usable. A hit takes a
+// concurrency slot only if the binding does not hold one already, and a
+// binding that is replaced gives its slot back. With leased every hit takes
+// a slot of its own, which belongs to the hit's lease.
+func (c *sessionCache) Next(token string, sel Selector, filters []Filter, leased bool) (Proxy, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if s, ok := c.sessions[token]; ok && !now.After(s.expires) {
+		if p, ok := c.pool.reuse(s.proxy, filters, leased || !s.holding); ok {
+			s.holding = !leased
+			c.sessions[token] = s
+			return p, nil
+		}
+	}
+	c.drop(token)
+
+	p, err := sel.Next(filters...)
+	if err != nil {
+		return Proxy{}, err
+	}
+	c.sessions[token] = session{proxy: p.String(), expires: now.Add(c.ttl), holding: !leased}
+	return p, nil
+}
+
+// Release frees the slot held by token's binding to proxy, if it holds
+// one, so a session reporting every use gives its slot back only once.
+func (c *sessionCache) Release(token, proxy string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.sessions[token]; ok && s.proxy == proxy && s.holding {
+		s.holding = false
+		c.sessions[token] = s
+		c.pool.Release(proxy)
+	}
+}
+
+// drop removes token's binding and frees the slot it holds. c.mu must be
+// held.
+func (c *sessionCache) drop(token string) {
+	if s, ok := c.sessions[token]; ok {
+		delete(c.sessions, token)
+		if s.holding {
+			c.pool.Release(s.proxy)
+		}
+	}
+}
+
+// Run periodically drops expired sessions until ctx is cancelled.
+func (c *sessionCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+// expire drops every session that has run out by now, freeing its slot.
+func (c *sessionCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for token, s := range c.sessions {
+		if now.After(s.expires) {
+			c.drop(token)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// settings is the service's full runtime configuration. Every field has a
+// flag and a matching PROXY_* environment variable (see envName); a flag
+// given on the command line wins over the environment, which wins over the
+// built-in default.
+type settings struct {
+	Listen           string
+	ConfigPath       string
+	Mock             int
+	MockFailRate     float64
+	CheckURL         string
+	CheckHTTPSURL    string
+	CheckExpect      string
+	Resolver         string
+	ForwardResolver  bool
+	CheckTimeout     time.Duration
+	CheckInterval    time.Duration
+	CheckConcurrency int
+	Strategy         string
+	MaxFailureRatio  float64
+	MinReports       int
+	QuarantineFor    time.Duration
+	Cooldown         time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	WarmUp           time.Duration
+	Forward          bool
+	ForwardRetries   int
+	ForwardTimeout   time.Duration
+	MaxResponseBytes int64
+	MaxHeaderBytes   int64
+	MaxInFlight      int
+	RetryStatuses    string
+	RetryMethods     string
+	HideCredentials  bool
+	MetricsAddr      string
+	ShutdownTimeout  time.Duration
+	StatePath        string
+	StateInterval    time.Duration
+	RateLimit        float64
+	RateBurst        int
+	RateClients      int
+	TrustXFF         bool
+	APIKeys          string
+	APIKeysFile      string
+	AdminKeys        string
+	SessionTTL       time.Duration
+	LeaseTTL         time.Duration
+	ProviderURL      string
+	ProviderInterval time.Duration
+	ProviderList     string
+	ProviderFieldMap string
+	TLSCert          string
+	TLSKey           string
+	TLSMinVersion    string
+	LogLevel         string
+	LogFormat        string
+	EventsOrigins    string
+
+	// retryStatuses is RetryStatuses parsed by validate.
+	retryStatuses map[int]bool
+	// eventsOrigins is EventsOrigins parsed by validate.
+	eventsOrigins map[string]bool
+}
+
+// secretFlags are flags whose values are redacted when settings are logged.
+var secretFlags = map[string]bool{"api-keys": true, "admin-keys": true}
+
+// envName returns the environment variable that configures a flag, e.g.
+// PROXY_CHECK_INTERVAL for -check-interval.
+func envName(flagName string) string {
+	return "PROXY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseSettings builds the configuration from args and the environment and
+// validates it. name names the command in usage messages, and extra, if not
+// nil, registers any flags of its own alongside the settings. The returned
+// FlagSet holds the effective values for logging.
+func parseSettings(name string, args []string, extra func(fs *flag.FlagSet)) (*settings, *flag.FlagSet, error) {
+	s := &settings{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&s.Listen, "listen", ":8080", "address and port to serve the API on, e.g. 127.0.0.1:9090")
+	fs.StringVar(&s.ConfigPath, "config", "", "path to JSON proxy config file")
+	fs.IntVar(&s.Mock, "mock", 0, "fill the pool with this many in-process fake upstream proxies instead of -config, for local testing")
+	fs.Float64Var(&s.MockFailRate, "mock-fail-rate", 0, "fraction of requests the -mock upstreams fail with 502, e.g. 0.2")
+	fs.StringVar(&s.CheckURL, "check-url", "http://httpbin.org/ip", "URL requested through each proxy during health checks")
+	fs.StringVar(&s.CheckHTTPSURL, "check-https-url", "", "also check each proxy's HTTPS tunnelling with this https:// URL (enables ?scheme=https)")
+	fs.StringVar(&s.CheckExpect, "check-expect", "", "mark a proxy unhealthy unless the check response contains this text; {host} stands for the proxy's host")
+	fs.StringVar(&s.Resolver, "resolver", "", "DNS server (host[:port]) used to resolve proxy hostnames in health checks, e.g. 1.1.1.1 (default system resolver)")
+	fs.BoolVar(&s.ForwardResolver, "forward-resolver", false, "use -resolver in forward mode too")
+	fs.DurationVar(&s.CheckTimeout, "check-timeout", 10*time.Second, "timeout for a single proxy health check")
+	fs.DurationVar(&s.CheckInterval, "check-interval", 60*time.Second, "how often to health-check the pool")
+	fs.IntVar(&s.CheckConcurrency, "check-concurrency", defaultCheckConcurrency, "how many proxies to health-check at once")
+	fs.StringVar(&s.Strategy, "strategy", "random", "proxy rotation strategy: random, lru or fastest")
+	fs.Float64Var(&s.MaxFailureRatio, "max-failure-ratio", 0.5, "quarantine a proxy once its reported failure ratio exceeds this (0 disables)")
+	fs.IntVar(&s.MinReports, "min-reports", 10, "reports needed before a proxy can be quarantined")
+	fs.DurationVar(&s.QuarantineFor, "quarantine", 5*time.Minute, "how long a quarantined proxy stays out of rotation")
+	fs.DurationVar(&s.Cooldown, "cooldown", 0, "skip a just-handed-out proxy for this long if others are free, e.g. 5s (0 disables)")
+	fs.IntVar(&s.BreakerThreshold, "breaker-failures", 0, "consecutive reported failures that open a proxy's circuit breaker (0 disables)")
+	fs.DurationVar(&s.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long an open breaker waits before letting one trial request through")
+	fs.DurationVar(&s.WarmUp, "warmup", 0, "ramp a newly added proxy's share of random and fastest selection from zero to full over this long, e.g. 10m (0 disables)")
+	fs.BoolVar(&s.Forward, "forward", false, "also act as an HTTP/HTTPS forward proxy, relaying requests through the pool")
+	fs.IntVar(&s.ForwardRetries, "forward-retries", 2, "extra upstreams to try in forward mode before returning 502")
+	fs.DurationVar(&s.ForwardTimeout, "forward-timeout", 60*time.Second, "time limit for a forwarded request across all attempts; 504 when exceeded (0 disables)")
+	fs.Int64Var(&s.MaxResponseBytes, "forward-max-response-bytes", 100<<20, "largest forwarded response body; bigger ones get 502 or are cut off (0 disables)")
+	fs.Int64Var(&s.MaxHeaderBytes, "forward-max-header-bytes", 1<<20, "largest forwarded response header block")
+	fs.IntVar(&s.MaxInFlight, "forward-max-inflight", 1024, "concurrent forwarded requests and tunnels allowed before answering 503 (0 disables)")
+	fs.StringVar(&s.RetryStatuses, "forward-retry-status", "502,503,504", "comma-separated upstream status codes that trigger failover")
+	fs.StringVar(&s.RetryMethods, "forward-retry-methods", "GET,HEAD", "comma-separated HTTP methods that may be retried through another upstream")
+	fs.BoolVar(&s.HideCredentials, "hide-credentials", false, "omit upstream credentials from /get-proxy (implies -forward)")
+	fs.StringVar(&s.MetricsAddr, "metrics-addr", "", "serve /metrics on this separate address instead of the API listener")
+	fs.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long to let in-flight requests drain on shutdown")
+	fs.StringVar(&s.StatePath, "state-file", "", "persist pool health and stats to this JSON file across restarts")
+	fs.DurationVar(&s.StateInterval, "state-interval", 30*time.Second, "how often to snapshot pool state to -state-file")
+	fs.Float64Var(&s.RateLimit, "rate-limit", 0, "requests per second allowed per client IP (0 disables)")
+	fs.IntVar(&s.RateBurst, "rate-burst", 20, "burst size for the per-client rate limit")
+	fs.IntVar(&s.RateClients, "rate-limit-clients", 10000, "maximum number of client IPs tracked by the rate limiter")
+	fs.BoolVar(&s.TrustXFF, "trust-xff", false, "identify clients by X-Forwarded-For (only behind a trusted reverse proxy)")
+	fs.StringVar(&s.APIKeys, "api-keys", "", "comma-separated API keys; when set (or -api-keys-file is), every request must present one")
+	fs.StringVar(&s.APIKeysFile, "api-keys-file", "", "file with one API key per line")
+	fs.StringVar(&s.AdminKeys, "admin-keys", "", "comma-separated keys for the /proxies admin endpoints (also accepted wherever an API key is)")
+	fs.DurationVar(&s.SessionTTL, "session-ttl", 10*time.Minute, "how long a ?session= token keeps getting the same proxy")
+	fs.DurationVar(&s.LeaseTTL, "lease-ttl", 0, "return each /get-proxy handout as a lease holding its concurrency slot for this long, e.g. 2m (0 disables)")
+	fs.StringVar(&s.ProviderURL, "provider-url", "", "fetch the proxy list from this provider API instead of -config")
+	fs.DurationVar(&s.ProviderInterval, "provider-interval", 5*time.Minute, "how often to refresh the list from -provider-url")
+	fs.StringVar(&s.ProviderList, "provider-list", "", "dot-separated path to the proxy array in the provider response (empty for a top-level array)")
+	fs.StringVar(&s.ProviderFieldMap, "provider-fields", "", "comma-separated attr=field renames for provider items, e.g. url=proxy,country=geo")
+	fs.StringVar(&s.TLSCert, "tls-cert", "", "serve HTTPS using this certificate file (requires -tls-key)")
+	fs.StringVar(&s.TLSKey, "tls-key", "", "private key file for -tls-cert")
+	fs.StringVar(&s.TLSMinVersion, "tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&s.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&s.LogFormat, "log-format", logFormatJSON, "access log format: json (with the other logs on stderr) or combined (NCSA Combined Log Format on stdout)")
+	fs.StringVar(&s.EventsOrigins, "events-origins", "", "comma-separated browser origins allowed to subscribe to /events besides the service's own, e.g. https://dash.example.com, or * for any")
+	if extra != nil {
+		extra(fs)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		f.Usage += fmt.Sprintf(" (env %s)", envName(f.Name))
+	})
+
+	fs.Parse(args)
+	if err := applyEnv(fs); err != nil {
+		return nil, nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, nil, err
+	}
+	return s, fs, nil
+}
+
+// applyEnv fills every flag not given on the command line from its
+// environment variable, if set.
+func applyEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", name, v, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// validate checks the settings for consistency, reporting every problem at
+// once rather than stopping at the first.
+func (s *settings) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if err := validateListenAddr(s.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("-listen: %w", err))
+	}
+	if s.MetricsAddr != "" {
+		if err := validateListenAddr(s.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("-metrics-addr: %w", err))
+		}
+	}
+	check(s.Mock >= 0, "-mock must not be negative")
+	check(s.Mock == 0 || (s.ConfigPath == "" && s.ProviderURL == ""), "-mock cannot be combined with -config or -provider-url")
+	check(s.MockFailRate >= 0 && s.MockFailRate <= 1, "-mock-fail-rate must be between 0 and 1")
+	check(s.CheckURL != "", "-check-url must not be empty")
+	check(s.CheckHTTPSURL == "" || strings.HasPrefix(s.CheckHTTPSURL, "https://"), "-check-https-url must be an https:// URL")
+	check(!s.ForwardResolver || s.Resolver != "", "-forward-resolver needs -resolver")
+	check(s.CheckTimeout > 0, "-check-timeout must be positive")
+	check(s.CheckInterval > 0, "-check-interval must be positive")
+	check(s.CheckConcurrency > 0, "-check-concurrency must be positive")
+	if _, err := newSelector(s.Strategy, nil); err != nil {
+		errs = append(errs, err)
+	}
+	check(s.MaxFailureRatio >= 0 && s.MaxFailureRatio <= 1, "-max-failure-ratio must be between 0 and 1")
+	check(s.MinReports >= 0, "-min-reports must not be negative")
+	check(s.QuarantineFor >= 0, "-quarantine must not be negative")
+	check(s.Cooldown >= 0, "-cooldown must not be negative")
+	check(s.BreakerThreshold >= 0, "-breaker-failures must not be negative")
+	check(s.BreakerCooldown > 0, "-breaker-cooldown must be positive")
+	check(s.WarmUp >= 0, "-warmup must not be negative")
+	check(s.ForwardRetries >= 0, "-forward-retries must not be negative")
+	check(s.ForwardTimeout >= 0, "-forward-timeout must not be negative")
+	check(s.MaxResponseBytes >= 0, "-forward-max-response-bytes must not be negative")
+	check(s.MaxHeaderBytes > 0, "-forward-max-header-bytes must be positive")
+	check(s.MaxInFlight >= 0, "-forward-max-inflight must not be negative")
+	statuses, err := parseRetryStatuses(s.RetryStatuses)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-forward-retry-status: %w", err))
+	}
+	s.retryStatuses = statuses
+	origins, err := parseOrigins(s.EventsOrigins)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("-events-origins: %w", err))
+	}
+	s.eventsOrigins = origins
+	check(s.ShutdownTimeout >= 0, "-shutdown-timeout must not be negative")
+	check(s.StateInterval > 0, "-state-interval must be positive")
+	check(s.RateLimit >= 0, "-rate-limit must not be negative")
+	check(s.RateLimit == 0 || s.RateBurst > 0, "-rate-burst must be positive when -rate-limit is set")
+	check(s.RateClients > 0, "-rate-limit-clients must be positive")
+	check(s.SessionTTL > 0, "-session-ttl must be positive")
+	check(s.LeaseTTL >= 0, "-lease-ttl must not be negative")
+	check(s.ConfigPath == "" || s.ProviderURL == "", "-config and -provider-url cannot be combined")
+	check(s.ProviderInterval > 0, "-provider-interval must be positive")
+	check((s.TLSCert == "") == (s.TLSKey == ""), "-tls-cert and -tls-key must be given together")
+	_, ok := tlsVersions[s.TLSMinVersion]
+	check(ok, "unsupported -tls-min-version %q (want 1.0, 1.1, 1.2 or 1.3)", s.TLSMinVersion)
+	check(s.LogFormat == logFormatJSON || s.LogFormat == logFormatCombined, "-log-format must be json or combined")
+	if _, err := newLogger(s.LogLevel); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// logSettings logs the effective value of every flag, redacting secrets.
+func logSettings(fs *flag.FlagSet) {
+	var attrs []any
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "REDACTED"
+		}
+		attrs = append(attrs, f.Name, v)
+	})
+	slog.Info("effective settings", attrs...)
+}
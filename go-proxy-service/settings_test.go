@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettingsPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string // PROXY_CHECK_TIMEOUT, if set
+		want time.Duration
+	}{
+		{"default", nil, "", 10 * time.Second},
+		{"env over default", nil, "3s", 3 * time.Second},
+		{"flag over env", []string{"-check-timeout", "5s"}, "3s", 5 * time.Second},
+		{"flag over default", []string{"-check-timeout=7s"}, "", 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("PROXY_CHECK_TIMEOUT", tt.env)
+			}
+			s, _, err := parseSettings("test", tt.args, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.CheckTimeout != tt.want {
+				t.Errorf("CheckTimeout = %s, want %s", s.CheckTimeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestSettingsInvalidEnv(t *testing.T) {
+	tests := []struct {
+		name, env, value, wantErr string
+	}{
+		{"unparsable", "PROXY_CHECK_TIMEOUT", "soon", "invalid PROXY_CHECK_TIMEOUT"},
+		{"fails validation", "PROXY_CHECK_TIMEOUT", "-1s", "-check-timeout must be positive"},
+		{"bad choice", "PROXY_LOG_FORMAT", "xml", "-log-format must be json or combined"},
+		{"conflicting sources", "PROXY_PROVIDER_URL", "http://provider.test/", "-config and -provider-url cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROXY_CONFIG", "proxies.json")
+			t.Setenv(tt.env, tt.value)
+			_, _, err := parseSettings("test", nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// configureTLS prepares hs to serve HTTPS with the given certificate and key
+// and minimum protocol version (one of tlsVersions). The certificate is
+// loaded up front so a bad path fails at startup rather than on first
+// connection.
+//
+// HTTP/2 is turned off when forward mode is on, because CONNECT tunnels
+// need to hijack the underlying HTTP/1.1 connection.
+func configureTLS(hs *http.Server, certFile, keyFile, minVersion string, forward bool) error {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return fmt.Errorf("unsupported TLS minimum version %q", minVersion)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	hs.TLSConfig = &tls.Config{
+		MinVersion:   version,
+		Certificates: []tls.Certificate{cert},
+	}
+	if forward {
+		hs.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return nil
+}
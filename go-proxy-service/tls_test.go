@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConfigureTLSRejectsUnknownVersion(t *testing.T) {
+	hs := &http.Server{}
+	err := configureTLS(hs, "cert.pem", "key.pem", "1.4", false)
+	if err == nil || !strings.Contains(err.Error(), "1.4") {
+		t.Fatalf("configureTLS with version 1.4 = %v, want an unsupported version error", err)
+	}
+	if hs.TLSConfig != nil {
+		t.Error("TLS configured despite the error")
+	}
+}